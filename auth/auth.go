@@ -0,0 +1,23 @@
+// Package auth checks the credentials of requests to the HTTP APIs.
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Bearer checks the request's bearer token, writing an error response and returning false if it doesn't match.
+// Features without a token configured are disabled entirely.
+func Bearer(w http.ResponseWriter, r *http.Request, token, feature string) bool {
+	if token == "" {
+		http.Error(w, feature+" is disabled", 403)
+		return false
+	}
+	actual := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(actual), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", 401)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
+	"github.com/TheLab-ms/access-controller-controller/sync"
+)
+
+const usage = `usage: access-controller-controller [command] [-controller name] [args]
+
+Runs the sync and reporting daemons when no command is given.
+
+Commands:
+  cards list                 list the cards on the access controller
+  cards add <fob> <name>     add a card
+  cards remove <id>          remove a card by its ID (not fob number)
+  swipes tail [-n 20] [-f]   print the most recent swipes, optionally following new ones
+  sync plan                  print the changes the next sync would make
+  sync apply [-approve]      sync once, approving removals held back by the removal limit if asked to
+
+Flags must come before any other arguments.
+`
+
+var errStopListing = errors.New("stop listing")
+
+// runCommand runs one of the operational subcommands against the configured access controllers, printing to w.
+func runCommand(ctx context.Context, w io.Writer, env *conf.Env, clients map[string]*client.Client, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	controller := flags.String("controller", "", "name of the access controller (optional when only one is configured)")
+	tailN := flags.Int("n", 20, "number of swipes to print")
+	follow := flags.Bool("f", false, "keep printing new swipes as they happen")
+	approve := flags.Bool("approve", false, "approve removals held back by the removal limit")
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+	for _, arg := range flags.Args() {
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("flag %s must come before the other arguments", arg) // the flag package stops at the first argument
+		}
+	}
+
+	name, cli, err := selectClient(clients, *controller)
+	if err != nil {
+		return err
+	}
+
+	switch cmd := args[0] + " " + args[1]; cmd {
+	case "cards list":
+		if flags.NArg() != 0 {
+			return errors.New("usage: cards list")
+		}
+		cards, err := cli.ListCards(ctx)
+		if err != nil {
+			return err
+		}
+		printCards(w, cards)
+		return nil
+
+	case "cards add":
+		if flags.NArg() != 2 {
+			return errors.New("usage: cards add <fob> <name>")
+		}
+		fob, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid fob number: %w", err)
+		}
+		return cli.AddCard(ctx, fob, flags.Arg(1))
+
+	case "cards remove":
+		if flags.NArg() != 1 {
+			return errors.New("usage: cards remove <id>")
+		}
+		id, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid card ID: %w", err)
+		}
+		return cli.RemoveCard(ctx, id)
+
+	case "swipes tail":
+		if flags.NArg() != 0 {
+			return errors.New("usage: swipes tail [-n 20] [-f]")
+		}
+		return tailSwipes(ctx, w, cli, *tailN, *follow)
+
+	case "sync plan", "sync apply":
+		if flags.NArg() != 0 {
+			return fmt.Errorf("usage: %s", cmd)
+		}
+		c, closeReporter, err := newSyncController(env, name, cli)
+		if err != nil {
+			return err
+		}
+		defer closeReporter()
+
+		if args[1] == "apply" {
+			changed, err := c.SyncOnce(ctx)
+			if err != nil && *approve && c.Approve() {
+				fmt.Fprintln(w, "approving the removals held back by the removal limit")
+				changed, err = c.SyncOnce(ctx)
+			}
+			if err != nil {
+				return err
+			}
+			if !changed {
+				fmt.Fprintln(w, "already in sync")
+			}
+			return nil
+		}
+
+		plan, err := c.Plan(ctx)
+		if err != nil {
+			return err
+		}
+		printPlan(w, plan)
+		return nil
+
+	default:
+		return errors.New(usage)
+	}
+}
+
+func selectClient(clients map[string]*client.Client, name string) (string, *client.Client, error) {
+	if name == "" {
+		if len(clients) != 1 {
+			return "", nil, errors.New("-controller is required when more than one access controller is configured")
+		}
+		for name, cli := range clients {
+			return name, cli, nil
+		}
+	}
+
+	cli := clients[name]
+	if cli == nil {
+		return "", nil, fmt.Errorf("unknown access controller %q", name)
+	}
+	return name, cli, nil
+}
+
+// newSyncController builds a sync controller configured just like the daemon's, including the reporting
+// database when enabled so that temporary access grants are taken into account. The returned function closes
+// the database connections.
+func newSyncController(env *conf.Env, name string, cli *client.Client) (*sync.Controller, func(), error) {
+	users, err := newIdentitySource(env)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring %s identity source: %w", env.IdentitySource, err)
+	}
+	if users == nil {
+		return nil, nil, errors.New("keycloak URL is not set")
+	}
+
+	var reporter *reporting.Controller
+	closeReporter := func() {}
+	if env.SwipeScrapeInterval != 0 {
+		reporter, err = reporting.NewController(env, map[string]*client.Client{name: cli}, users)
+		if err != nil {
+			return nil, nil, fmt.Errorf("configuring reporting controller: %w", err)
+		}
+		closeReporter = reporter.Close
+	}
+
+	return sync.NewController(env, name, cli, users, reporter, nil), closeReporter, nil
+}
+
+func tailSwipes(ctx context.Context, w io.Writer, cli *client.Client, n int, follow bool) error {
+	latest := []*client.CardSwipe{}
+	err := cli.ListSwipes(ctx, -1, func(swipe *client.CardSwipe) error {
+		latest = append(latest, swipe)
+		if len(latest) >= n {
+			return errStopListing
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopListing) {
+		return err
+	}
+
+	lastID := -1
+	printSwipes := func(swipes []*client.CardSwipe) {
+		sort.Slice(swipes, func(i, j int) bool { return swipes[i].ID < swipes[j].ID })
+		for _, swipe := range swipes {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", swipe.ID, swipe.Time.Format("2006-01-02 15:04:05"), swipe.CardID, swipe.DoorID, swipe.Status, swipe.Name)
+			lastID = swipe.ID
+		}
+	}
+	printSwipes(latest)
+
+	for follow {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second * 5):
+		}
+
+		swipes := []*client.CardSwipe{}
+		err := cli.ListSwipes(ctx, lastID, func(swipe *client.CardSwipe) error {
+			swipes = append(swipes, swipe)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		printSwipes(swipes)
+	}
+	return nil
+}
+
+func printCards(w io.Writer, cards []*client.Card) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNUMBER\tNAME")
+	for _, card := range cards {
+		fmt.Fprintf(tw, "%d\t%d\t%s\n", card.ID, card.Number, card.Name)
+	}
+	tw.Flush()
+}
+
+func printPlan(w io.Writer, plan *sync.Plan) {
+	for _, conflict := range plan.Conflicts {
+		fmt.Fprintf(w, "fob %d is claimed by more than one user: giving it to %s (%s) instead of %s\n", conflict.Number, conflict.Winner, conflict.Reason, strings.Join(conflict.Losers, ", "))
+	}
+	if plan.Empty() {
+		fmt.Fprintln(w, "already in sync")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tID\tNUMBER\tNAME\tREASON")
+	for _, removal := range plan.Remove {
+		fmt.Fprintf(tw, "remove\t%d\t%d\t%s\t%s\n", removal.Card.ID, removal.Card.Number, removal.Card.Name, removal.Reason)
+	}
+	for _, add := range plan.Add {
+		fmt.Fprintf(tw, "add\t\t%d\t%s\t%s\n", add.Number, add.Name, add.Reason)
+	}
+	tw.Flush()
+}
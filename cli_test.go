@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/simulator"
+	"github.com/TheLab-ms/access-controller-controller/sync"
+)
+
+func TestRunCommand(t *testing.T) {
+	sim := simulator.New()
+	svr := httptest.NewServer(sim)
+	t.Cleanup(svr.Close)
+	sim.PutCard(500, "Unmanaged User")
+	sim.PutCard(501, "592af5478f6842d88b814a5d233b0099") // managed but no longer in the roster
+	sim.PutCard(502, "592af5478f6842d88b814a5d233b0098")
+
+	roster := filepath.Join(t.TempDir(), "roster.yaml")
+	require.NoError(t, os.WriteFile(roster, []byte("- uuid: 592af547-8f68-42d8-8b81-4a5d233b0001\n  name: Some Member\n  fob: 9001\n"), 0600))
+	env := &conf.Env{IdentitySource: "file", RosterFile: roster, SyncMaxRemovals: 1}
+	clients := map[string]*client.Client{
+		conf.DefaultAccessControllerName: {Addr: strings.TrimPrefix(svr.URL, "http://"), Timeout: time.Second},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		output  []string // substrings of the output
+		wantErr string
+	}{
+		{name: "no command", args: []string{"cards"}, wantErr: "usage:"},
+		{name: "unknown command", args: []string{"cards", "shuffle"}, wantErr: "usage:"},
+		{name: "unknown controller", args: []string{"cards", "list", "-controller", "garage"}, wantErr: `unknown access controller "garage"`},
+		{name: "list", args: []string{"cards", "list"}, output: []string{"Unmanaged User", "501"}},
+		{name: "list with extra args", args: []string{"cards", "list", "everything"}, wantErr: "usage: cards list"},
+		{name: "add", args: []string{"cards", "add", "123", "Some Guest"}},
+		{name: "added", args: []string{"cards", "list", "-controller", "default"}, output: []string{"123", "Some Guest"}},
+		{name: "add with missing name", args: []string{"cards", "add", "124"}, wantErr: "usage: cards add <fob> <name>"},
+		{name: "add with invalid fob", args: []string{"cards", "add", "nope", "Some Guest"}, wantErr: "invalid fob number"},
+		{name: "trailing flag", args: []string{"cards", "add", "125", "Some Guest", "-controller", "default"}, wantErr: "flag -controller must come before the other arguments"},
+		{name: "remove with invalid ID", args: []string{"cards", "remove", "nope"}, wantErr: "invalid card ID"},
+		{name: "plan", args: []string{"sync", "plan"}, output: []string{"remove", "592af5478f6842d88b814a5d233b0099", "add", "9001", "authorized user has no card"}},
+		{name: "apply over the removal limit", args: []string{"sync", "apply"}, wantErr: "plan removes 2 cards, which exceeds the limit of 1"},
+		{name: "trailing approve", args: []string{"sync", "apply", "-controller", "default", "now", "-approve"}, wantErr: "flag -approve must come before the other arguments"},
+		{name: "apply with extra args", args: []string{"sync", "apply", "now"}, wantErr: "usage: sync apply"},
+		{name: "apply with approval", args: []string{"sync", "apply", "-approve"}, output: []string{"approving the removals held back by the removal limit"}},
+		{name: "applied", args: []string{"sync", "plan"}, output: []string{"already in sync"}},
+		{name: "apply when in sync", args: []string{"sync", "apply"}, output: []string{"already in sync"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := runCommand(context.Background(), out, env, clients, tc.args)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			for _, s := range tc.output {
+				assert.Contains(t, out.String(), s)
+			}
+		})
+	}
+
+	// The cards that weren't added by sync are left alone
+	numbers := []int{}
+	for _, card := range sim.Cards() {
+		numbers = append(numbers, card.Number)
+	}
+	assert.ElementsMatch(t, []int{123, 500, 9001}, numbers)
+}
+
+func TestPrintPlan(t *testing.T) {
+	out := &bytes.Buffer{}
+	printPlan(out, &sync.Plan{
+		Remove: []*sync.Removal{{Card: &client.Card{ID: 3, Number: 100, Name: "592af5478f6842d88b814a5d233b0002"}, Reason: "no authorized user has this fob"}},
+		Add:    []*sync.Addition{{Number: 200, Name: "592af5478f6842d88b814a5d233b0001", Reason: "authorized user has no card"}},
+		Conflicts: []*sync.Conflict{{
+			Number: 200,
+			Winner: "592af547-8f68-42d8-8b81-4a5d233b0001",
+			Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0003"},
+			Reason: "oldest account",
+		}},
+	})
+	assert.Equal(t, `fob 200 is claimed by more than one user: giving it to 592af547-8f68-42d8-8b81-4a5d233b0001 (oldest account) instead of 592af547-8f68-42d8-8b81-4a5d233b0003
+ACTION  ID  NUMBER  NAME                              REASON
+remove  3   100     592af5478f6842d88b814a5d233b0002  no authorized user has this fob
+add         200     592af5478f6842d88b814a5d233b0001  authorized user has no card
+`, out.String())
+
+	out.Reset()
+	printPlan(out, &sync.Plan{})
+	assert.Equal(t, "already in sync\n", out.String())
+}
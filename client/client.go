@@ -20,13 +20,27 @@ import (
 var ErrCardIDConflict = errors.New("badge ID already in use")
 
 type CardSwipe struct {
-	ID     int    // increments for each log entry
-	Name   string // name associated with the CardID
-	CardID int
-	DoorID string
-	Time   time.Time
+	ID        int    // increments for each log entry
+	Name      string // name associated with the CardID
+	CardID    int
+	DoorID    string
+	Status    SwipeStatus
+	RawStatus string // as displayed by the access controller e.g. "Allow IN[#1DOOR]"
+	Time      time.Time
 }
 
+// SwipeStatus is the outcome of a swipe log entry, parsed from its raw status text.
+type SwipeStatus string
+
+const (
+	SwipeAllowed     SwipeStatus = "allowed"
+	SwipeDenied      SwipeStatus = "denied"       // not parsed yet, see parseSwipeStatus
+	SwipeUnknownCard SwipeStatus = "unknown_card" // not parsed yet, see parseSwipeStatus
+	SwipeRemoteOpen  SwipeStatus = "remote_open"
+	SwipeReboot      SwipeStatus = "reboot" // the access controller restarted, not a swipe at all
+	SwipeOther       SwipeStatus = "other"  // door alarms, button presses, etc.
+)
+
 type Card struct {
 	ID     int    // assigned when adding
 	Number int    // encoded on the fob
@@ -35,6 +49,7 @@ type Card struct {
 
 type Client struct {
 	Addr    string
+	Name    string // identifies the access controller in metrics
 	Timeout time.Duration
 
 	mut  sync.Mutex
@@ -57,7 +72,7 @@ func (c *Client) AddCard(ctx context.Context, num int, name string) error {
 		return err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -91,7 +106,8 @@ func (c *Client) RemoveCard(ctx context.Context, id int) error {
 	if err := c.startRemoving(ctx, id); err != nil {
 		return fmt.Errorf("starting removal: %w", err)
 	}
-	if err := c.confirmRemoving(ctx, id); err != nil {
+	// The controller is left halfway through the delete form if we stop here, so finish even when the context is canceled
+	if err := c.confirmRemoving(context.Background(), id); err != nil {
 		return fmt.Errorf("confirming removal: %w", err)
 	}
 
@@ -105,7 +121,7 @@ func (c *Client) startRemoving(ctx context.Context, id int) error {
 		return err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -130,7 +146,7 @@ func (c *Client) confirmRemoving(ctx context.Context, id int) error {
 		return err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -148,6 +164,42 @@ func (c *Client) confirmRemoving(ctx context.Context, id int) error {
 	return nil
 }
 
+// OpenDoor remotely unlocks a door, numbered from 1, just like the "Remote Open" buttons on the home page.
+//
+// Unverified: unlike the other requests, the form action and success message haven't been captured from a real
+// device yet (there's no fixture for them), so this may fail with "unknown error response" until they are.
+func (c *Client) OpenDoor(ctx context.Context, door int) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if err := c.login(ctx); err != nil {
+		return fmt.Errorf("logging in: %w", err)
+	}
+
+	q := fmt.Sprintf("D%d=Remote+Open", door-1)
+	req, err := http.NewRequest("POST", "http://"+c.Addr+"/ACT_ID_22", strings.NewReader(q))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.doHTTP(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Contains(body, []byte("Open Successfully")) {
+		return fmt.Errorf("unknown error response: %s", body)
+	}
+
+	return nil
+}
+
 func (c *Client) ListCards(ctx context.Context) ([]*Card, error) {
 	c.mut.Lock()
 	defer c.mut.Unlock()
@@ -192,7 +244,7 @@ func (c *Client) listCardPage(ctx context.Context, startID int) ([]*Card, error)
 		return nil, err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -207,18 +259,17 @@ func (c *Client) ListSwipes(ctx context.Context, earliestID int, fn func(*CardSw
 	c.mut.Lock()
 	defer c.mut.Unlock()
 
-	i := 0
 	latestID := -1
 	for {
 		page, err := c.listSwipePage(ctx, latestID)
 		if err != nil {
 			return err
 		}
+		if len(page) == 0 {
+			return nil // reached the beginning of the log
+		}
 
-		for i, item := range page {
-			if i == 0 {
-				latestID = item.ID - len(page)
-			}
+		for _, item := range page {
 			if item.ID <= earliestID {
 				return nil
 			}
@@ -226,7 +277,9 @@ func (c *Client) ListSwipes(ctx context.Context, earliestID int, fn func(*CardSw
 				return err
 			}
 		}
-		i++
+
+		// Continue from the oldest entry we've seen rather than assuming a full page
+		latestID = page[len(page)-1].ID - 1
 	}
 }
 
@@ -236,7 +289,7 @@ func (c *Client) listSwipePage(ctx context.Context, earliestID int) ([]*CardSwip
 		return nil, err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -269,7 +322,7 @@ func (c *Client) login(ctx context.Context) error {
 		return err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -293,7 +346,7 @@ func (c *Client) reset(ctx context.Context) error {
 		return err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTP(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -302,17 +355,38 @@ func (c *Client) reset(ctx context.Context) error {
 	return nil
 }
 
-func (c *Client) doHTTP(req *http.Request) (resp *http.Response, err error) {
+// doHTTP sends the request over the shared connection. The context is checked before the request is sent and bounds
+// its deadline, but a request that has been written is always given a chance to finish.
+func (c *Client) doHTTP(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		requestDuration.WithLabelValues(c.Name, req.URL.Path, result).Observe(time.Since(start).Seconds())
+	}()
+
 	if c.conn == nil {
 		log.Printf("establishing new connection to the access control server")
-		c.conn, err = net.DialTimeout("tcp", c.Addr, c.Timeout)
+		connectionsTotal.WithLabelValues(c.Name).Inc()
+		dialer := &net.Dialer{Timeout: c.Timeout}
+		c.conn, err = dialer.DialContext(ctx, "tcp", c.Addr)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
 	defer c.conn.SetDeadline(time.Time{}) // remove timeout
-	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	c.conn.SetDeadline(deadline)
 
 	if err := req.Write(c.conn); err != nil {
 		c.conn = nil
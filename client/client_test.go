@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/simulator"
+)
+
+func TestClientAgainstSimulator(t *testing.T) {
+	sim := simulator.New()
+	svr := httptest.NewServer(sim)
+	t.Cleanup(svr.Close)
+
+	ctx := context.Background()
+	cli := &Client{Addr: strings.TrimPrefix(svr.URL, "http://"), Timeout: time.Second}
+
+	t.Run("add cards", func(t *testing.T) {
+		for i := 0; i < 45; i++ {
+			require.NoError(t, cli.AddCard(ctx, 1000+i, fmt.Sprintf("card%d", i)))
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		assert.ErrorIs(t, cli.AddCard(ctx, 1000, "another"), ErrCardIDConflict)
+	})
+
+	t.Run("list across pages", func(t *testing.T) {
+		cards, err := cli.ListCards(ctx)
+		require.NoError(t, err)
+		require.Len(t, cards, 45)
+		for i, card := range cards {
+			assert.Equal(t, &Card{ID: i + 1, Number: 1000 + i, Name: fmt.Sprintf("card%d", i)}, card)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, cli.RemoveCard(ctx, 22))
+		require.NoError(t, cli.RemoveCard(ctx, 1))
+
+		cards, err := cli.ListCards(ctx)
+		require.NoError(t, err)
+		require.Len(t, cards, 43)
+		for _, card := range cards {
+			assert.NotContains(t, []int{1, 22}, card.ID)
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.ErrorIs(t, cli.AddCard(canceled, 2000, "late"), context.Canceled)
+		assert.ErrorIs(t, cli.RemoveCard(canceled, 2), context.Canceled)
+
+		cards, err := cli.ListCards(ctx)
+		require.NoError(t, err)
+		assert.Len(t, cards, 43)
+	})
+
+	t.Run("remove missing card", func(t *testing.T) {
+		require.Error(t, cli.RemoveCard(ctx, 22))
+	})
+
+	t.Run("list swipes", func(t *testing.T) {
+		for i := 0; i < 30; i++ {
+			sim.Swipe(1002, "#1DOOR")
+		}
+		sim.Reboot()
+		sim.Swipe(1003, "#2DOOR")
+
+		swipes := []*CardSwipe{}
+		err := cli.ListSwipes(ctx, -1, func(cs *CardSwipe) error {
+			swipes = append(swipes, cs)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, swipes, 32)
+		assert.Equal(t, 32, swipes[0].ID)
+		assert.Equal(t, "#2DOOR", swipes[0].DoorID)
+		assert.Equal(t, "card3", swipes[0].Name)
+		assert.Equal(t, SwipeAllowed, swipes[0].Status)
+		assert.Equal(t, 31, swipes[1].ID)
+		assert.Equal(t, SwipeReboot, swipes[1].Status)
+		assert.Equal(t, 1, swipes[31].ID)
+		assert.Equal(t, 1002, swipes[31].CardID)
+	})
+
+	t.Run("open door", func(t *testing.T) {
+		require.NoError(t, cli.OpenDoor(ctx, 2))
+		require.Error(t, cli.OpenDoor(ctx, 9))
+
+		records := sim.Records()
+		assert.Equal(t, "Remote Open[#2DOOR]", records[len(records)-1].Status)
+	})
+
+	t.Run("list swipes since cursor", func(t *testing.T) {
+		sim.Swipe(1004, "#1DOOR")
+
+		ids := []int{}
+		err := cli.ListSwipes(ctx, 30, func(cs *CardSwipe) error {
+			ids = append(ids, cs.ID)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []int{34, 33, 32, 31}, ids)
+	})
+}
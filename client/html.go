@@ -46,23 +46,37 @@ func (s *swipeBuilder) ProcessCell(col int, val string) {
 	case 1:
 		s.current.CardID, _ = strconv.Atoi(val)
 	case 2:
-		s.current.Name = val
+		s.current.Name = strings.TrimSpace(val) // empty cells are rendered as &nbsp;
 	case 3:
-		if strings.Contains(val, "Reboot") {
-			s.current.ID = 0 // discard
-		}
-		if strings.Contains(val, "Allow IN") {
-			s.current.DoorID = doorFromStatusRegex.FindString(val)
-			if s.current.DoorID != "" {
-				// remove square braces
-				s.current.DoorID = s.current.DoorID[1 : len(s.current.DoorID)-1]
-			}
+		s.current.RawStatus = val
+		s.current.Status = parseSwipeStatus(val)
+		s.current.DoorID = doorFromStatusRegex.FindString(val)
+		if s.current.DoorID != "" {
+			// remove square braces
+			s.current.DoorID = s.current.DoorID[1 : len(s.current.DoorID)-1]
 		}
 	case 4:
 		s.current.Time, _ = time.Parse("2006-01-02 15:04:05", val)
 	}
 }
 
+// parseSwipeStatus only recognizes the statuses seen in real swipe logs (see the fixtures), plus the remote opens
+// recorded by OpenDoor. Denied swipes and unknown cards are left as SwipeOther until we know how the access controller
+// words them, so nothing acts on a guess. The raw status is stored either way.
+func parseSwipeStatus(val string) SwipeStatus {
+	lower := strings.ToLower(val)
+	switch {
+	case strings.Contains(lower, "reboot"):
+		return SwipeReboot
+	case strings.Contains(lower, "remote open"):
+		return SwipeRemoteOpen
+	case strings.Contains(lower, "allow"):
+		return SwipeAllowed
+	default:
+		return SwipeOther
+	}
+}
+
 type cardBuilder struct {
 	current *Card
 	set     []*Card
@@ -51,3 +51,18 @@ func TestParseCardsList(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expected, actual)
 }
+
+func TestParseSwipeStatus(t *testing.T) {
+	for raw, expected := range map[string]SwipeStatus{
+		"Allow IN[#1DOOR]":    SwipeAllowed,
+		"Allow IN[#2DOOR]":    SwipeAllowed,
+		"Reboot":              SwipeReboot,
+		"Remote Open[#3DOOR]": SwipeRemoteOpen,
+
+		// Not seen from a real access controller yet, so they aren't guessed at
+		"Deny IN[#2DOOR]":           SwipeOther,
+		"Unregistered Card[#1DOOR]": SwipeOther,
+	} {
+		assert.Equal(t, expected, parseSwipeStatus(raw), raw)
+	}
+}
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "access_controller_http_request_duration_seconds",
+		Help:    "Latency of requests to the access controller's web interface, including failed requests.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"controller", "path", "result"})
+
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_controller_connections_total",
+		Help: "Connections established to the access controller. Anything beyond the first is a reconnect after an error.",
+	}, []string{"controller"})
+)
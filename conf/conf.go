@@ -1,25 +1,145 @@
 package conf
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
 type Env struct {
-	AccessControlHost    string        `required:"true" split_words:"true"`
-	AccessControlTimeout time.Duration `default:"5s" split_words:"true"`
+	AccessControlHost    string            `split_words:"true"`
+	AccessControllers    AccessControllers `split_words:"true"`
+	AccessControlTimeout time.Duration     `default:"5s" split_words:"true"`
 
 	PostgresHost     string `split_words:"true"`
 	PostgresUser     string `default:"postgres" split_words:"true"`
 	PostgresPassword string `split_words:"true"`
 
-	KeycloakURL       string `split_words:"true"`
-	KeycloakRealm     string `default:"master" split_words:"true"`
-	AuthorizedGroupID string `split_words:"true"`
+	KeycloakURL        string   `split_words:"true"`
+	KeycloakRealm      string   `default:"master" split_words:"true"`
+	AuthorizedGroupID  string   `split_words:"true"`
+	AuthorizedGroupIDs []string `split_words:"true"`
+	ScheduleTimezone   string   `default:"UTC" split_words:"true"`
+
+	KeycloakIncludeSubgroups     bool     `split_words:"true"` // off by default so upgrading doesn't grant anyone new access
+	KeycloakKeyfobAttribute      string   `default:"keyfobID" split_words:"true"`
+	KeycloakScheduleAttribute    string   `default:"accessSchedule" split_words:"true"`
+	KeycloakExpiresAtAttribute   string   `default:"accessExpiresAt" split_words:"true"`
+	KeycloakRequiredAttributes   []string `default:"buildingAccessApprover" split_words:"true"`
+	KeycloakRequireEnabled       bool     `split_words:"true"`
+	KeycloakRequireEmailVerified bool     `split_words:"true"`
+	KeycloakRequiredGroups       []string `split_words:"true"`
+	KeycloakExcludedGroups       []string `split_words:"true"`
+
+	IdentitySource string `default:"keycloak" split_words:"true"`
+	RosterFile     string `split_words:"true"`
+	IdentityURL    string `split_words:"true"`
+	IdentityToken  string `split_words:"true"`
+
+	LDAPServerURL          string `split_words:"true"`
+	LDAPBindDN             string `split_words:"true"`
+	LDAPBindPassword       string `split_words:"true"`
+	LDAPBaseDN             string `split_words:"true"`
+	LDAPFilter             string `default:"(objectClass=person)" split_words:"true"`
+	LDAPUserIDAttribute    string `default:"entryUUID" split_words:"true"`
+	LDAPNameAttribute      string `default:"cn" split_words:"true"`
+	LDAPKeyfobAttribute    string `default:"keyfobID" split_words:"true"`
+	LDAPScheduleAttribute  string `split_words:"true"`
+	LDAPExpiresAtAttribute string `split_words:"true"`
 
 	ResyncInterval time.Duration `default:"1h" split_words:"true"`
 	CallbackURL    string        `split_words:"true"`
 	WebhookAddr    string        `split_words:"true"`
+	WebhookSecret  string        `split_words:"true"`
+	DebugToken     string        `split_words:"true"`
+
+	WebhookOwner            string `default:"access-controller-controller" split_words:"true"`
+	WebhookRemoveOnShutdown bool   `split_words:"true"`
+
+	SyncDryRun               bool `split_words:"true"`
+	SyncMaxRemovals          int  `default:"20" split_words:"true"`
+	SyncMaxRemovalPercent    int  `split_words:"true"`
+	SyncMaxScheduledRemovals int  `default:"100" split_words:"true"` // removals because access schedules or grants ended
+
+	RemoteOpenToken   string `split_words:"true"`
+	RemoteOpenEnabled bool   `split_words:"true"` // off until the request has been verified against a real device
+	GrantToken        string `split_words:"true"`
+
+	OutboundWebhookURLs   []string `split_words:"true"`
+	OutboundWebhookSecret string   `split_words:"true"`
+
+	MQTTBrokerURL   string `split_words:"true"`
+	MQTTUsername    string `split_words:"true"`
+	MQTTPassword    string `split_words:"true"`
+	MQTTTopicPrefix string `default:"access-controller" split_words:"true"`
+
+	ProbeAddr             string        `default:":8888" split_words:"true"`
+	SwipeScrapeInterval   time.Duration `default:"2h" split_words:"true"`
+	SwipeFastPollInterval time.Duration `split_words:"true"`
+	SwipeStreamToken      string        `split_words:"true"`
+}
+
+// DefaultAccessControllerName is the name given to the controller configured by AccessControlHost.
+const DefaultAccessControllerName = "default"
+
+// Controllers returns every configured access controller, including the one given by AccessControlHost.
+func (e *Env) Controllers() (AccessControllers, error) {
+	all := AccessControllers{}
+	if e.AccessControlHost != "" {
+		all = append(all, AccessController{Name: DefaultAccessControllerName, Host: e.AccessControlHost})
+	}
+	all = append(all, e.AccessControllers...)
+
+	seen := map[string]struct{}{}
+	for _, ac := range all {
+		if _, ok := seen[ac.Name]; ok {
+			return nil, fmt.Errorf("access controller name %q is used more than once", ac.Name)
+		}
+		seen[ac.Name] = struct{}{}
+	}
+	if len(all) == 0 {
+		return nil, errors.New("at least one access controller must be configured")
+	}
+
+	return all, nil
+}
+
+// AuthorizedGroups returns the UUIDs of every Keycloak group that should be granted building access, including AuthorizedGroupID.
+func (e *Env) AuthorizedGroups() []string {
+	all := []string{}
+	seen := map[string]struct{}{}
+	for _, id := range append([]string{e.AuthorizedGroupID}, e.AuthorizedGroupIDs...) {
+		id = strings.TrimSpace(id)
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		all = append(all, id)
+	}
+	return all
+}
+
+type AccessController struct {
+	Name string
+	Host string // hostname:port of the web interface
+}
+
+// AccessControllers is decoded from a comma-separated list of name=hostname:port pairs.
+type AccessControllers []AccessController
+
+func (a *AccessControllers) Decode(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
 
-	ProbeAddr           string        `default:":8888" split_words:"true"`
-	SwipeScrapeInterval time.Duration `default:"2h" split_words:"true"`
+		name, host, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || host == "" {
+			return fmt.Errorf("invalid access controller %q, expected name=hostname:port", pair)
+		}
+		*a = append(*a, AccessController{Name: name, Host: host})
+	}
+	return nil
 }
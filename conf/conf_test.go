@@ -0,0 +1,46 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessControllersDecode(t *testing.T) {
+	acs := AccessControllers{}
+	require.NoError(t, acs.Decode("front=10.0.0.5:80, back=10.0.0.6:8080,"))
+	assert.Equal(t, AccessControllers{
+		{Name: "front", Host: "10.0.0.5:80"},
+		{Name: "back", Host: "10.0.0.6:8080"},
+	}, acs)
+
+	assert.Error(t, (&AccessControllers{}).Decode("10.0.0.5:80"))
+	assert.Error(t, (&AccessControllers{}).Decode("front="))
+}
+
+func TestControllers(t *testing.T) {
+	env := &Env{}
+	_, err := env.Controllers()
+	assert.EqualError(t, err, "at least one access controller must be configured")
+
+	env.AccessControlHost = "10.0.0.5:80"
+	env.AccessControllers = AccessControllers{{Name: "back", Host: "10.0.0.6:80"}}
+	acs, err := env.Controllers()
+	require.NoError(t, err)
+	assert.Equal(t, AccessControllers{
+		{Name: "default", Host: "10.0.0.5:80"},
+		{Name: "back", Host: "10.0.0.6:80"},
+	}, acs)
+
+	env.AccessControllers = append(env.AccessControllers, AccessController{Name: "default", Host: "10.0.0.7:80"})
+	_, err = env.Controllers()
+	assert.EqualError(t, err, `access controller name "default" is used more than once`)
+}
+
+func TestAuthorizedGroups(t *testing.T) {
+	assert.Empty(t, (&Env{}).AuthorizedGroups())
+
+	env := &Env{AuthorizedGroupID: "members", AuthorizedGroupIDs: []string{"staff", " volunteers", "members"}}
+	assert.Equal(t, []string{"members", "staff", "volunteers"}, env.AuthorizedGroups())
+}
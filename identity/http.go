@@ -0,0 +1,53 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+// HTTP lists users from an endpoint that responds with a JSON array of records.
+type HTTP struct {
+	url, token string
+	loc        *time.Location
+	client     *http.Client
+}
+
+// NewHTTP creates a source that fetches users from IdentityURL, sending IdentityToken as a bearer token when it's set.
+func NewHTTP(c *conf.Env, loc *time.Location) *HTTP {
+	return &HTTP{url: c.IdentityURL, token: c.IdentityToken, loc: loc, client: &http.Client{Timeout: time.Second * 30}}
+}
+
+func (h *HTTP) ListUsers(ctx context.Context) ([]*AccessUser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode, body)
+	}
+
+	records := []*Record{}
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return accessUsers(h.url, records, h.loc), nil
+}
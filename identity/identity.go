@@ -0,0 +1,128 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/schedule"
+)
+
+// AccessUser is someone who should be given building access.
+type AccessUser struct {
+	UUID, Name    string
+	KeyfobNumbers []int              // each fob gets its own card on the access controller
+	Schedule      *schedule.Schedule // nil when access isn't limited to particular times
+	ExpiresAt     time.Time          // zero when access doesn't expire
+	CreatedAt     time.Time          // when the account was created, zero if unknown (decides who keeps a shared fob)
+}
+
+// Source lists the users who should be given building access e.g. Keycloak or a roster file.
+type Source interface {
+	ListUsers(ctx context.Context) ([]*AccessUser, error)
+}
+
+// Record is a user as given by the roster file and HTTP sources, before it's been validated.
+type Record struct {
+	UUID      string `json:"uuid" yaml:"uuid"`
+	Name      string `json:"name" yaml:"name"`
+	Fob       int    `json:"fob,omitempty" yaml:"fob,omitempty"`
+	Fobs      []int  `json:"fobs,omitempty" yaml:"fobs,omitempty"` // for users with more than one fob
+	Schedule  string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty" yaml:"expiresAt,omitempty"`
+}
+
+// uuidPattern matches uuids with or without dashes, since they're used as card names on the access controller.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// AccessUser validates the record, returning an error if the user shouldn't be given access.
+func (r *Record) AccessUser(loc *time.Location) (*AccessUser, error) {
+	if !uuidPattern.MatchString(strings.ReplaceAll(r.UUID, "-", "")) {
+		return nil, fmt.Errorf("expected a uuid, got %q", r.UUID)
+	}
+	user := &AccessUser{UUID: r.UUID, Name: r.Name}
+	fobs := r.Fobs
+	if r.Fob != 0 {
+		fobs = append([]int{r.Fob}, fobs...)
+	}
+	for _, fob := range fobs {
+		if fob <= 0 {
+			return nil, fmt.Errorf("invalid fob number %d", fob)
+		}
+		user.KeyfobNumbers = appendUnique(user.KeyfobNumbers, fob)
+	}
+	if len(user.KeyfobNumbers) == 0 {
+		return nil, fmt.Errorf("missing fob number")
+	}
+
+	if r.Schedule != "" {
+		sched, err := schedule.Parse(r.Schedule, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access schedule: %w", err)
+		}
+		user.Schedule = sched
+	}
+	if r.ExpiresAt != "" {
+		t, err := ParseExpiration(r.ExpiresAt, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access expiration: %w", err)
+		}
+		user.ExpiresAt = t
+	}
+	return user, nil
+}
+
+// accessUsers validates every record, logging and skipping the invalid ones so one typo doesn't lock everyone out.
+func accessUsers(source string, records []*Record, loc *time.Location) []*AccessUser {
+	all := []*AccessUser{}
+	for i, record := range records {
+		user, err := record.AccessUser(loc)
+		if err != nil {
+			log.Printf("denying access to user %d (%q) from %s: %s", i+1, record.UUID, source, err)
+			continue
+		}
+		all = append(all, user)
+	}
+	return all
+}
+
+// ParseFobs parses fob numbers, allowing more than one to be given in each value separated by commas, semicolons,
+// or spaces. Duplicates are removed.
+func ParseFobs(values ...string) ([]int, error) {
+	fobs := []int{}
+	for _, val := range values {
+		for _, field := range strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+			fob, err := strconv.Atoi(field)
+			if err != nil || fob <= 0 {
+				return nil, fmt.Errorf("invalid fob number %q", field)
+			}
+			fobs = appendUnique(fobs, fob)
+		}
+	}
+	return fobs, nil
+}
+
+func appendUnique(fobs []int, fob int) []int {
+	for _, f := range fobs {
+		if f == fob {
+			return fobs
+		}
+	}
+	return append(fobs, fob)
+}
+
+// ParseExpiration accepts either an RFC3339 timestamp or a date, which expires at the end of that day.
+func ParseExpiration(val string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", val, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC3339 timestamp or YYYY-MM-DD date, got %q", val)
+	}
+	return t.AddDate(0, 0, 1), nil
+}
@@ -0,0 +1,110 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+func TestRecordAccessUser(t *testing.T) {
+	record := &Record{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Name: "Some Member", Fob: 123, Schedule: "Mon 17:00-22:00", ExpiresAt: "2023-06-19"}
+	user, err := record.AccessUser(time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, []int{123}, user.KeyfobNumbers)
+	assert.Equal(t, "Mon 17:00-22:00", user.Schedule.String())
+	assert.Equal(t, time.Date(2023, 6, 20, 0, 0, 0, 0, time.UTC), user.ExpiresAt)
+
+	record = &Record{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Fob: 123, Fobs: []int{456, 123}}
+	user, err = record.AccessUser(time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, []int{123, 456}, user.KeyfobNumbers)
+
+	for _, invalid := range []*Record{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Fobs: []int{123, -1}},
+		{UUID: "some-member", Fob: 123},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001"},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Fob: 123, Schedule: "sometimes"},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Fob: 123, ExpiresAt: "tomorrow"},
+	} {
+		_, err := invalid.AccessUser(time.UTC)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRoster(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	t.Run("yaml", func(t *testing.T) {
+		path := filepath.Join(dir, "roster.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+- uuid: 592af547-8f68-42d8-8b81-4a5d233b0001
+  name: Some Member
+  fob: 100
+  schedule: Mon-Fri 17:00-22:00
+- uuid: 592af547-8f68-42d8-8b81-4a5d233b0002
+  name: Missing Fob
+`), 0600))
+
+		users, err := NewRoster(&conf.Env{RosterFile: path}, time.UTC).ListUsers(ctx)
+		require.NoError(t, err)
+		require.Len(t, users, 1) // the invalid user is skipped
+		assert.Equal(t, "Some Member", users[0].Name)
+		assert.Equal(t, []int{100}, users[0].KeyfobNumbers)
+		assert.NotNil(t, users[0].Schedule)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		path := filepath.Join(dir, "roster.csv")
+		require.NoError(t, os.WriteFile(path, []byte("uuid,name,fob,expiresAt\n592af547-8f68-42d8-8b81-4a5d233b0001,Some Member,100,\n592af5478f6842d88b814a5d233b0002, \"Guest, Some\", 200;201, 2023-06-19\n"), 0600))
+
+		users, err := NewRoster(&conf.Env{RosterFile: path}, time.UTC).ListUsers(ctx)
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+		assert.Equal(t, []int{100}, users[0].KeyfobNumbers)
+		assert.True(t, users[0].ExpiresAt.IsZero())
+		assert.Equal(t, "Guest, Some", users[1].Name)
+		assert.Equal(t, []int{200, 201}, users[1].KeyfobNumbers)
+		assert.False(t, users[1].ExpiresAt.IsZero())
+	})
+
+	t.Run("invalid csv", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.csv")
+		require.NoError(t, os.WriteFile(path, []byte("uuid,name\n592af547-8f68-42d8-8b81-4a5d233b0001,Some Member\n"), 0600))
+
+		_, err := NewRoster(&conf.Env{RosterFile: path}, time.UTC).ListUsers(ctx)
+		assert.ErrorContains(t, err, "missing fob column")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewRoster(&conf.Env{RosterFile: filepath.Join(dir, "nope.yaml")}, time.UTC).ListUsers(ctx)
+		assert.Error(t, err)
+	})
+}
+
+func TestHTTP(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		w.Write([]byte(`[{"uuid": "592af547-8f68-42d8-8b81-4a5d233b0001", "name": "Some Member", "fob": 100}, {"uuid": "nope", "fob": 200}]`))
+	}))
+	t.Cleanup(svr.Close)
+
+	users, err := NewHTTP(&conf.Env{IdentityURL: svr.URL, IdentityToken: "secret"}, time.UTC).ListUsers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []*AccessUser{{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Name: "Some Member", KeyfobNumbers: []int{100}}}, users)
+
+	_, err = NewHTTP(&conf.Env{IdentityURL: svr.URL, IdentityToken: "wrong"}, time.UTC).ListUsers(context.Background())
+	assert.ErrorContains(t, err, "unexpected response status: 401")
+}
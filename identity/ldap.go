@@ -0,0 +1,116 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+// LDAP lists users from an LDAP directory. Every entry matching the filter is given access if it has a valid fob number.
+type LDAP struct {
+	url, bindDN, bindPassword string
+	baseDN, filter            string
+	attrs                     ldapAttributes
+	loc                       *time.Location
+}
+
+// ldapAttributes are the names of the attributes holding each field of a Record. Schedule and ExpiresAt are optional.
+type ldapAttributes struct {
+	UUID, Name, Fob, Schedule, ExpiresAt string
+}
+
+func NewLDAP(c *conf.Env, loc *time.Location) *LDAP {
+	return &LDAP{
+		url:          c.LDAPServerURL,
+		bindDN:       c.LDAPBindDN,
+		bindPassword: c.LDAPBindPassword,
+		baseDN:       c.LDAPBaseDN,
+		filter:       c.LDAPFilter,
+		attrs: ldapAttributes{
+			UUID:      c.LDAPUserIDAttribute,
+			Name:      c.LDAPNameAttribute,
+			Fob:       c.LDAPKeyfobAttribute,
+			Schedule:  c.LDAPScheduleAttribute,
+			ExpiresAt: c.LDAPExpiresAtAttribute,
+		},
+		loc: loc,
+	}
+}
+
+func (l *LDAP) ListUsers(ctx context.Context) ([]*AccessUser, error) {
+	conn, err := ldap.DialURL(l.url)
+	if err != nil {
+		return nil, fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close()
+
+	// The client doesn't take a context, so the deadline is the best we can do
+	timeout := time.Second * 30
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	conn.SetTimeout(timeout)
+
+	if l.bindDN != "" {
+		if err := conn.Bind(l.bindDN, l.bindPassword); err != nil {
+			return nil, fmt.Errorf("binding: %w", err)
+		}
+	}
+
+	attrs := []string{l.attrs.UUID, l.attrs.Name, l.attrs.Fob}
+	if l.attrs.Schedule != "" {
+		attrs = append(attrs, l.attrs.Schedule)
+	}
+	if l.attrs.ExpiresAt != "" {
+		attrs = append(attrs, l.attrs.ExpiresAt)
+	}
+	req := ldap.NewSearchRequest(l.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, l.filter, attrs, nil)
+	result, err := conn.SearchWithPaging(req, 500)
+	if err != nil {
+		return nil, fmt.Errorf("searching: %w", err)
+	}
+
+	records := []*Record{}
+	for _, entry := range result.Entries {
+		records = append(records, l.newRecord(entry))
+	}
+	return accessUsers(l.url, records, l.loc), nil
+}
+
+// newRecord maps the entry's attributes to a record, leaving fields empty when they're missing or invalid so
+// the record fails validation.
+func (l *LDAP) newRecord(entry *ldap.Entry) *Record {
+	record := &Record{
+		UUID:      ldapUUID(entry.GetRawAttributeValue(l.attrs.UUID)),
+		Name:      entry.GetAttributeValue(l.attrs.Name),
+		Schedule:  strings.Join(entry.GetAttributeValues(l.attrs.Schedule), ";"),
+		ExpiresAt: entry.GetAttributeValue(l.attrs.ExpiresAt),
+	}
+	fobs, err := ParseFobs(entry.GetAttributeValues(l.attrs.Fob)...)
+	if err != nil {
+		fobs = []int{-1} // fails validation
+	}
+	record.Fobs = fobs
+	if record.UUID == "" {
+		record.UUID = entry.DN // shows up in the log when the record is denied
+	}
+	return record
+}
+
+// ldapUUID formats binary GUIDs like Active Directory's objectGUID as strings. Other values are returned as-is,
+// since directories like OpenLDAP return entryUUID as a string already.
+func ldapUUID(val []byte) string {
+	if len(val) != 16 {
+		return string(val)
+	}
+
+	// The first three groups are little-endian
+	b := []byte{val[3], val[2], val[1], val[0], val[5], val[4], val[7], val[6]}
+	b = append(b, val[8:]...)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
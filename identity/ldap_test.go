@@ -0,0 +1,42 @@
+package identity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+func TestLDAPRecord(t *testing.T) {
+	l := NewLDAP(&conf.Env{LDAPUserIDAttribute: "entryUUID", LDAPNameAttribute: "cn", LDAPKeyfobAttribute: "employeeNumber", LDAPScheduleAttribute: "accessSchedule"}, time.UTC)
+
+	entry := ldap.NewEntry("uid=member,ou=people,dc=example,dc=com", map[string][]string{
+		"entryUUID":      {"592af547-8f68-42d8-8b81-4a5d233b0001"},
+		"cn":             {"Some Member"},
+		"employeeNumber": {" 100 "},
+		"accessSchedule": {"Mon 17:00-22:00", "Sat 09:00-21:00"},
+	})
+	user, err := l.newRecord(entry).AccessUser(time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "592af547-8f68-42d8-8b81-4a5d233b0001", user.UUID)
+	assert.Equal(t, "Some Member", user.Name)
+	assert.Equal(t, []int{100}, user.KeyfobNumbers)
+	assert.Equal(t, "Mon 17:00-22:00; Sat 09:00-21:00", user.Schedule.String())
+
+	// entries without a fob are denied, and identified by their DN
+	record := l.newRecord(ldap.NewEntry("uid=nobody,ou=people,dc=example,dc=com", map[string][]string{"cn": {"Nobody"}}))
+	assert.Equal(t, "uid=nobody,ou=people,dc=example,dc=com", record.UUID)
+	_, err = record.AccessUser(time.UTC)
+	assert.Error(t, err)
+}
+
+func TestLDAPUUID(t *testing.T) {
+	// Active Directory's objectGUID is binary with the first three groups in little-endian order
+	guid := []byte{0x47, 0xf5, 0x2a, 0x59, 0x68, 0x8f, 0xd8, 0x42, 0x8b, 0x81, 0x4a, 0x5d, 0x23, 0x3b, 0x00, 0x01}
+	assert.Equal(t, "592af547-8f68-42d8-8b81-4a5d233b0001", ldapUUID(guid))
+	assert.Equal(t, "592af547-8f68-42d8-8b81-4a5d233b0001", ldapUUID([]byte("592af547-8f68-42d8-8b81-4a5d233b0001")))
+}
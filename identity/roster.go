@@ -0,0 +1,93 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+// Roster lists users from a YAML or CSV file. The file is read every time so it can be edited without a restart.
+type Roster struct {
+	path string
+	loc  *time.Location
+}
+
+func NewRoster(c *conf.Env, loc *time.Location) *Roster {
+	return &Roster{path: c.RosterFile, loc: loc}
+}
+
+func (r *Roster) ListUsers(ctx context.Context) ([]*AccessUser, error) {
+	buf, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	if strings.EqualFold(filepath.Ext(r.path), ".csv") {
+		records, err = parseRosterCSV(bytes.NewReader(buf))
+	} else {
+		err = yaml.Unmarshal(buf, &records)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing roster file %s: %w", r.path, err)
+	}
+
+	return accessUsers(r.path, records, r.loc), nil
+}
+
+// parseRosterCSV reads records from a CSV file with a header row naming the columns.
+// The uuid, name, and fob columns are required. The schedule and expiresAt columns are optional.
+// Users with more than one fob can list them in the fob column separated by semicolons or spaces.
+func parseRosterCSV(r io.Reader) ([]*Record, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"uuid", "name", "fob"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("missing %s column", required)
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := cols[name]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	records := []*Record{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := &Record{UUID: get(row, "uuid"), Name: get(row, "name"), Schedule: get(row, "schedule"), ExpiresAt: get(row, "expiresAt")}
+		record.Fobs, err = ParseFobs(get(row, "fob"))
+		if err != nil {
+			line, _ := cr.FieldPos(cols["fob"])
+			return nil, fmt.Errorf("%w on line %d", err, line)
+		}
+		records = append(records, record)
+	}
+}
@@ -7,16 +7,24 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 
 	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/identity"
 )
 
 type Keycloak struct {
-	client                  *gocloak.GoCloak
-	realm, baseURL, groupID string
+	client           *gocloak.GoCloak
+	realm, baseURL   string
+	groupIDs         []string // authorized groups
+	includeSubgroups bool
+	rules            *Rules
+	scheduleLocation *time.Location
+
+	groups atomic.Pointer[[]string] // every group that affected access as of the last listing, including subgroups
 
 	// use ensureToken to access these
 	tokenLock      sync.Mutex
@@ -24,20 +32,186 @@ type Keycloak struct {
 	tokenFetchTime time.Time
 }
 
-func New(c *conf.Env) *Keycloak {
-	return &Keycloak{client: gocloak.NewClient(c.KeycloakURL), realm: c.KeycloakRealm, baseURL: c.KeycloakURL, groupID: c.AuthorizedGroupID}
+func New(c *conf.Env) (*Keycloak, error) {
+	loc, err := time.LoadLocation(c.ScheduleTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("loading schedule timezone: %w", err)
+	}
+	rules, err := NewRules(c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access rules: %w", err)
+	}
+	return &Keycloak{
+		client:           gocloak.NewClient(c.KeycloakURL),
+		realm:            c.KeycloakRealm,
+		baseURL:          c.KeycloakURL,
+		groupIDs:         c.AuthorizedGroups(),
+		includeSubgroups: c.KeycloakIncludeSubgroups,
+		rules:            rules,
+		scheduleLocation: loc,
+	}, nil
 }
 
-func (k *Keycloak) ListUsers(ctx context.Context) ([]*AccessUser, error) {
+// Rules returns the rules that decide which members of the authorized groups are given access.
+func (k *Keycloak) Rules() *Rules { return k.rules }
+
+// Groups returns the UUIDs of the authorized groups and every group used by the rules, along with the subgroups
+// that were found the last time users were listed.
+func (k *Keycloak) Groups() []string {
+	if groups := k.groups.Load(); groups != nil {
+		return *groups
+	}
+	return append(append([]string{}, k.groupIDs...), k.rules.Groups()...)
+}
+
+// ListUsers lists the eligible members of every authorized group and (optionally) their subgroups.
+// Users in more than one group are only listed once.
+func (k *Keycloak) ListUsers(ctx context.Context) ([]*identity.AccessUser, error) {
 	token, err := k.ensureToken(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getting token: %w", err)
 	}
+	visited := map[string]struct{}{} // every group that affects access
+
+	// The members endpoint doesn't include each user's groups, so list the members of the groups the rules care about
+	groupsByUser := map[string]map[string]struct{}{}
+	for _, groupID := range k.rules.Groups() {
+		members, err := k.listMembers(ctx, token, groupID, visited)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range members {
+			id := gocloak.PString(user.ID)
+			if groupsByUser[id] == nil {
+				groupsByUser[id] = map[string]struct{}{}
+			}
+			groupsByUser[id][groupID] = struct{}{}
+		}
+	}
+
+	all := []*identity.AccessUser{}
+	seen := map[string]struct{}{}
+	for _, groupID := range k.groupIDs {
+		users, err := k.listMembers(ctx, token, groupID, visited)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			id := gocloak.PString(user.ID)
+			if _, ok := seen[id]; ok {
+				continue // already listed by another group
+			}
+			seen[id] = struct{}{}
+
+			u := k.rules.newAccessUser(user, groupsByUser[id], k.scheduleLocation)
+			if u == nil {
+				continue // not eligible for access
+			}
+			all = append(all, u)
+		}
+	}
+
+	groups := make([]string, 0, len(visited))
+	for id := range visited {
+		groups = append(groups, id)
+	}
+	k.groups.Store(&groups)
+
+	userCount.Set(float64(len(all)))
+	return all, nil
+}
+
+// listMembers lists the members of the group and, if enabled, all of its subgroups without duplicates.
+// The UUID of every group that was listed is added to groups.
+func (k *Keycloak) listMembers(ctx context.Context, token *gocloak.JWT, groupID string, groups map[string]struct{}) ([]*gocloak.User, error) {
+	all := []*gocloak.User{}
+	seen := map[string]struct{}{}
+	visited := map[string]struct{}{}
+
+	queue := []string{groupID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+		groups[id] = struct{}{}
+
+		users, err := k.listGroupMembers(ctx, token, id)
+		if err != nil {
+			return nil, fmt.Errorf("listing members of group %s: %w", id, err)
+		}
+		for _, user := range users {
+			if _, ok := seen[gocloak.PString(user.ID)]; !ok {
+				seen[gocloak.PString(user.ID)] = struct{}{}
+				all = append(all, user)
+			}
+		}
+
+		if !k.includeSubgroups {
+			continue
+		}
+		children, err := k.listSubgroups(ctx, token, id)
+		if err != nil {
+			return nil, fmt.Errorf("listing subgroups of group %s: %w", id, err)
+		}
+		queue = append(queue, children...)
+	}
+
+	return all, nil
+}
+
+// listSubgroups returns the UUIDs of the group's direct subgroups.
+func (k *Keycloak) listSubgroups(ctx context.Context, token *gocloak.JWT, groupID string) ([]string, error) {
+	var (
+		max   = 100
+		first = 0
+		all   = []string{}
+	)
+	for {
+		// Keycloak 23+ only returns subgroups from this endpoint
+		var children []*gocloak.Group
+		resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+			SetResult(&children).
+			SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(max)}).
+			Get(fmt.Sprintf("%s/admin/realms/%s/groups/%s/children", k.baseURL, k.realm, groupID))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() == 404 || resp.StatusCode() == 405 {
+			break // older versions include them in the group instead
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+		}
+		if len(children) == 0 {
+			return all, nil
+		}
+		first += len(children)
+		for _, child := range children {
+			all = append(all, gocloak.PString(child.ID))
+		}
+	}
 
+	group, err := k.client.GetGroup(ctx, token.AccessToken, k.realm, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group.SubGroups != nil {
+		for _, child := range *group.SubGroups {
+			all = append(all, gocloak.PString(child.ID))
+		}
+	}
+	return all, nil
+}
+
+func (k *Keycloak) listGroupMembers(ctx context.Context, token *gocloak.JWT, groupID string) ([]*gocloak.User, error) {
 	var (
 		max   = 50
 		first = 0
-		all   = []*AccessUser{}
+		all   = []*gocloak.User{}
 	)
 	for {
 		params, err := gocloak.GetQueryParams(gocloak.GetUsersParams{
@@ -51,28 +225,22 @@ func (k *Keycloak) ListUsers(ctx context.Context) ([]*AccessUser, error) {
 		// Unfortunately the keycloak client doesn't support the group membership endpoint.
 		// We reuse the client's transport here while specifying our own URL.
 		var users []*gocloak.User
-		_, err = k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+		resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
 			SetResult(&users).
 			SetQueryParams(params).
-			Get(fmt.Sprintf("%s/admin/realms/%s/groups/%s/members", k.baseURL, k.realm, k.groupID))
+			Get(fmt.Sprintf("%s/admin/realms/%s/groups/%s/members", k.baseURL, k.realm, groupID))
 		if err != nil {
 			return nil, err
 		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+		}
 		if len(users) == 0 {
-			break
+			return all, nil
 		}
 		first += len(users)
-
-		for _, user := range users {
-			u := newAccessUser(user)
-			if u == nil {
-				continue // invalid user (should be impossible)
-			}
-			all = append(all, u)
-		}
+		all = append(all, users...)
 	}
-
-	return all, nil
 }
 
 func (k *Keycloak) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
@@ -82,12 +250,15 @@ func (k *Keycloak) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
 	}
 
 	webhooks := []*Webhook{}
-	_, err = k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+	resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
 		SetResult(&webhooks).
 		Get(fmt.Sprintf("%s/realms/%s/webhooks", k.baseURL, k.realm))
 	if err != nil {
 		return nil, err
 	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+	}
 
 	return webhooks, nil
 }
@@ -98,12 +269,52 @@ func (k *Keycloak) CreateWebhook(ctx context.Context, webhook *Webhook) error {
 		return fmt.Errorf("getting token: %w", err)
 	}
 
-	_, err = k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+	resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
 		SetBody(webhook).
 		Post(fmt.Sprintf("%s/realms/%s/webhooks", k.baseURL, k.realm))
 	if err != nil {
 		return err
 	}
+	if resp.IsError() {
+		return fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
+
+func (k *Keycloak) UpdateWebhook(ctx context.Context, webhook *Webhook) error {
+	token, err := k.ensureToken(ctx)
+	if err != nil {
+		return fmt.Errorf("getting token: %w", err)
+	}
+
+	resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+		SetBody(webhook).
+		Put(fmt.Sprintf("%s/realms/%s/webhooks/%s", k.baseURL, k.realm, webhook.ID))
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
+
+func (k *Keycloak) DeleteWebhook(ctx context.Context, id string) error {
+	token, err := k.ensureToken(ctx)
+	if err != nil {
+		return fmt.Errorf("getting token: %w", err)
+	}
+
+	resp, err := k.client.GetRequestWithBearerAuth(ctx, token.AccessToken).
+		Delete(fmt.Sprintf("%s/realms/%s/webhooks/%s", k.baseURL, k.realm, id))
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode(), resp.Body())
+	}
 
 	return nil
 }
@@ -137,36 +348,11 @@ func (k *Keycloak) ensureToken(ctx context.Context) (*gocloak.JWT, error) {
 	return k.token, nil
 }
 
-type AccessUser struct {
-	UUID, Name   string
-	KeyfobNumber int
-}
-
-func newAccessUser(kcuser *gocloak.User) *AccessUser {
-	if kcuser.ID == nil || kcuser.Attributes == nil {
-		return nil
-	}
-
-	attr := *kcuser.Attributes
-	fobID, _ := strconv.Atoi(firstElOrZeroVal(attr["keyfobID"]))
-	if fobID == 0 {
-		return nil
-	}
-	if firstElOrZeroVal(attr["buildingAccessApprover"]) == "" {
-		return nil // no access for accounts that haven't explicitly been granted building access
-	}
-
-	return &AccessUser{
-		UUID:         *kcuser.ID,
-		Name:         fmt.Sprintf("%s %s", gocloak.PString(kcuser.FirstName), gocloak.PString(kcuser.LastName)),
-		KeyfobNumber: fobID,
-	}
-}
-
 type Webhook struct {
 	ID         string   `json:"id"`
 	Enabled    bool     `json:"enabled"`
 	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"` // used to sign requests, not returned when listing
 	EventTypes []string `json:"eventTypes"`
 }
 
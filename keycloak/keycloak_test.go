@@ -0,0 +1,116 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListUsersNestedGroups(t *testing.T) {
+	user := func(id string, fob int) *gocloak.User {
+		return &gocloak.User{ID: gocloak.StringP(id), Attributes: &map[string][]string{
+			"keyfobID":               {fmt.Sprint(fob)},
+			"buildingAccessApprover": {"someone"},
+		}}
+	}
+	members := map[string][]*gocloak.User{
+		"members":      {user("a", 100), user("b", 200)},
+		"tier1":        {user("b", 200), user("c", 300)},
+		"tier2":        {user("d", 400)},
+		"staff":        {user("a", 100), user("e", 500)},
+		"staff-events": {user("f", 600)},
+	}
+	children := map[string][]string{"members": {"tier1"}, "tier1": {"tier2"}}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/realms/test/groups/"), "/")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case len(parts) == 2 && parts[1] == "members":
+			if r.URL.Query().Get("first") != "0" {
+				w.Write([]byte("[]"))
+				return
+			}
+			json.NewEncoder(w).Encode(members[parts[0]])
+		case len(parts) == 2 && parts[1] == "children" && parts[0] == "staff":
+			http.NotFound(w, r) // simulate an older Keycloak
+		case len(parts) == 2 && parts[1] == "children" && parts[0] == "staff-events":
+			http.Error(w, "method not allowed", 405) // some older versions only allow POST here
+		case len(parts) == 1 && parts[0] == "staff":
+			json.NewEncoder(w).Encode(&gocloak.Group{ID: gocloak.StringP("staff"), SubGroups: &[]gocloak.Group{{ID: gocloak.StringP("staff-events")}}})
+		case len(parts) == 2 && parts[1] == "children":
+			groups := []*gocloak.Group{}
+			if r.URL.Query().Get("first") == "0" {
+				for _, id := range children[parts[0]] {
+					groups = append(groups, &gocloak.Group{ID: gocloak.StringP(id)})
+				}
+			}
+			json.NewEncoder(w).Encode(groups)
+		case len(parts) == 1:
+			json.NewEncoder(w).Encode(&gocloak.Group{ID: gocloak.StringP(parts[0]), SubGroups: &[]gocloak.Group{}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(svr.Close)
+
+	k := &Keycloak{
+		client:           gocloak.NewClient(svr.URL),
+		realm:            "test",
+		baseURL:          svr.URL,
+		groupIDs:         []string{"members", "staff"},
+		includeSubgroups: true,
+		rules:            &Rules{KeyfobAttribute: "keyfobID", RequiredAttributes: map[string]string{"buildingAccessApprover": ""}},
+		scheduleLocation: time.UTC,
+		token:            &gocloak.JWT{AccessToken: "token", ExpiresIn: 3600},
+		tokenFetchTime:   time.Now(),
+	}
+
+	users, err := k.ListUsers(context.Background())
+	require.NoError(t, err)
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.UUID)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, ids)
+
+	groups := k.Groups()
+	sort.Strings(groups)
+	assert.Equal(t, []string{"members", "staff", "staff-events", "tier1", "tier2"}, groups)
+
+	k.includeSubgroups = false
+	users, err = k.ListUsers(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, users, 3)
+}
+
+func TestListUsersErrorStatus(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", 403) // e.g. the client lost its view-users role
+	}))
+	t.Cleanup(svr.Close)
+
+	k := &Keycloak{
+		client:           gocloak.NewClient(svr.URL),
+		realm:            "test",
+		baseURL:          svr.URL,
+		groupIDs:         []string{"members"},
+		rules:            &Rules{KeyfobAttribute: "keyfobID"},
+		scheduleLocation: time.UTC,
+		token:            &gocloak.JWT{AccessToken: "token", ExpiresIn: 3600},
+		tokenFetchTime:   time.Now(),
+	}
+
+	_, err := k.ListUsers(context.Background())
+	assert.ErrorContains(t, err, "unexpected response status: 403")
+}
@@ -0,0 +1,11 @@
+package keycloak
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var userCount = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "keycloak_authorized_users",
+	Help: "Members of the authorized Keycloak groups who meet the access rules as of the last time they were listed.",
+})
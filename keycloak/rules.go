@@ -0,0 +1,152 @@
+package keycloak
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/identity"
+	"github.com/TheLab-ms/access-controller-controller/schedule"
+)
+
+// Rules decide which members of the authorized group are given access, and which attributes hold their details.
+type Rules struct {
+	KeyfobAttribute    string
+	ScheduleAttribute  string
+	ExpiresAtAttribute string
+
+	// RequiredAttributes must be set on the user. An attribute with an empty value can have any (non-empty) value,
+	// otherwise one of the attribute's values must match it.
+	RequiredAttributes map[string]string
+
+	RequireEnabled       bool
+	RequireEmailVerified bool
+	RequiredGroups       []string // UUIDs of groups the user must also be a member of
+	ExcludedGroups       []string // UUIDs of groups whose members are denied access
+}
+
+// NewRules reads the rules from the environment.
+func NewRules(c *conf.Env) (*Rules, error) {
+	r := &Rules{
+		KeyfobAttribute:      c.KeycloakKeyfobAttribute,
+		ScheduleAttribute:    c.KeycloakScheduleAttribute,
+		ExpiresAtAttribute:   c.KeycloakExpiresAtAttribute,
+		RequiredAttributes:   map[string]string{},
+		RequireEnabled:       c.KeycloakRequireEnabled,
+		RequireEmailVerified: c.KeycloakRequireEmailVerified,
+		RequiredGroups:       c.KeycloakRequiredGroups,
+		ExcludedGroups:       c.KeycloakExcludedGroups,
+	}
+	if r.KeyfobAttribute == "" {
+		return nil, fmt.Errorf("keyfob attribute must be set")
+	}
+	for _, req := range c.KeycloakRequiredAttributes {
+		name, value, _ := strings.Cut(strings.TrimSpace(req), "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid required attribute %q, expected name or name=value", req)
+		}
+		r.RequiredAttributes[name] = value
+	}
+	return r, nil
+}
+
+// Attributes returns the names of every attribute that affects whether a user has access.
+func (r *Rules) Attributes() []string {
+	names := []string{r.KeyfobAttribute}
+	for name := range r.RequiredAttributes {
+		names = append(names, name)
+	}
+	for _, name := range []string{r.ScheduleAttribute, r.ExpiresAtAttribute} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Groups returns the UUIDs of every group other than the authorized group that affects whether a user has access.
+func (r *Rules) Groups() []string {
+	return append(append([]string{}, r.RequiredGroups...), r.ExcludedGroups...)
+}
+
+// newAccessUser returns nil if the user isn't eligible for access according to the rules.
+// groups is the set of UUIDs of the required and excluded groups the user is a member of.
+func (r *Rules) newAccessUser(kcuser *gocloak.User, groups map[string]struct{}, loc *time.Location) *identity.AccessUser {
+	if kcuser.ID == nil || kcuser.Attributes == nil {
+		return nil
+	}
+	if r.RequireEnabled && !gocloak.PBool(kcuser.Enabled) {
+		return nil
+	}
+	if r.RequireEmailVerified && !gocloak.PBool(kcuser.EmailVerified) {
+		return nil
+	}
+	for _, id := range r.RequiredGroups {
+		if _, ok := groups[id]; !ok {
+			return nil
+		}
+	}
+	for _, id := range r.ExcludedGroups {
+		if _, ok := groups[id]; ok {
+			return nil
+		}
+	}
+
+	attr := *kcuser.Attributes
+	fobs, err := identity.ParseFobs(attr[r.KeyfobAttribute]...)
+	if err != nil {
+		log.Printf("denying access to user %s because their fob is invalid: %s", *kcuser.ID, err)
+		return nil
+	}
+	if len(fobs) == 0 {
+		return nil
+	}
+	for name, value := range r.RequiredAttributes {
+		if !hasAttributeValue(attr[name], value) {
+			return nil // no access for accounts that haven't explicitly been granted building access
+		}
+	}
+
+	user := &identity.AccessUser{
+		UUID:          *kcuser.ID,
+		Name:          fmt.Sprintf("%s %s", gocloak.PString(kcuser.FirstName), gocloak.PString(kcuser.LastName)),
+		KeyfobNumbers: fobs,
+	}
+	if kcuser.CreatedTimestamp != nil {
+		user.CreatedAt = time.UnixMilli(*kcuser.CreatedTimestamp)
+	}
+
+	if windows := attr[r.ScheduleAttribute]; r.ScheduleAttribute != "" && len(windows) > 0 {
+		sched, err := schedule.Parse(strings.Join(windows, ";"), loc)
+		if err != nil {
+			log.Printf("denying access to user %s because their access schedule is invalid: %s", user.UUID, err)
+			return nil
+		}
+		user.Schedule = sched
+	}
+
+	if exp := firstElOrZeroVal(attr[r.ExpiresAtAttribute]); r.ExpiresAtAttribute != "" && exp != "" {
+		t, err := identity.ParseExpiration(exp, loc)
+		if err != nil {
+			log.Printf("denying access to user %s because their access expiration is invalid: %s", user.UUID, err)
+			return nil
+		}
+		user.ExpiresAt = t
+	}
+
+	return user
+}
+
+// hasAttributeValue returns true if any of the values match, or if any are non-empty when value is empty.
+func hasAttributeValue(values []string, value string) bool {
+	for _, v := range values {
+		if (value == "" && v != "") || (value != "" && v == value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package keycloak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/conf"
+)
+
+func TestNewRules(t *testing.T) {
+	r, err := NewRules(&conf.Env{
+		KeycloakKeyfobAttribute:    "badge",
+		KeycloakRequiredAttributes: []string{"approvedBy", "membershipStatus=active"},
+		KeycloakExcludedGroups:     []string{"suspended"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"approvedBy": "", "membershipStatus": "active"}, r.RequiredAttributes)
+	assert.ElementsMatch(t, []string{"badge", "approvedBy", "membershipStatus"}, r.Attributes())
+	assert.Equal(t, []string{"suspended"}, r.Groups())
+
+	_, err = NewRules(&conf.Env{KeycloakKeyfobAttribute: "badge", KeycloakRequiredAttributes: []string{"=active"}})
+	assert.Error(t, err)
+}
+
+func TestRulesNewAccessUser(t *testing.T) {
+	r := &Rules{
+		KeyfobAttribute:      "badge",
+		ScheduleAttribute:    "hours",
+		RequiredAttributes:   map[string]string{"approvedBy": "", "membershipStatus": "active"},
+		RequireEnabled:       true,
+		RequireEmailVerified: true,
+		RequiredGroups:       []string{"waiver-signed"},
+		ExcludedGroups:       []string{"suspended"},
+	}
+	newUser := func(fn func(*gocloak.User)) *gocloak.User {
+		u := &gocloak.User{
+			ID:               gocloak.StringP("592af547-8f68-42d8-8b81-4a5d233b0001"),
+			FirstName:        gocloak.StringP("Some"),
+			LastName:         gocloak.StringP("Member"),
+			Enabled:          gocloak.BoolP(true),
+			EmailVerified:    gocloak.BoolP(true),
+			CreatedTimestamp: gocloak.Int64P(1687132800000),
+			Attributes: &map[string][]string{
+				"badge":            {"123", "456"},
+				"approvedBy":       {"someone"},
+				"membershipStatus": {"active"},
+				"hours":            {"Mon 17:00-22:00"},
+			},
+		}
+		if fn != nil {
+			fn(u)
+		}
+		return u
+	}
+	groups := map[string]struct{}{"waiver-signed": {}}
+
+	user := r.newAccessUser(newUser(nil), groups, time.UTC)
+	require.NotNil(t, user)
+	assert.Equal(t, "Some Member", user.Name)
+	assert.Equal(t, []int{123, 456}, user.KeyfobNumbers)
+	assert.Equal(t, "Mon 17:00-22:00", user.Schedule.String())
+	assert.True(t, user.CreatedAt.Equal(time.Date(2023, 6, 19, 0, 0, 0, 0, time.UTC)))
+
+	for name, tc := range map[string]struct {
+		user   *gocloak.User
+		groups map[string]struct{}
+	}{
+		"disabled":               {newUser(func(u *gocloak.User) { u.Enabled = gocloak.BoolP(false) }), groups},
+		"email not verified":     {newUser(func(u *gocloak.User) { u.EmailVerified = nil }), groups},
+		"missing fob":            {newUser(func(u *gocloak.User) { delete(*u.Attributes, "badge") }), groups},
+		"invalid fob":            {newUser(func(u *gocloak.User) { (*u.Attributes)["badge"] = []string{"123", "lost"} }), groups},
+		"not approved":           {newUser(func(u *gocloak.User) { (*u.Attributes)["approvedBy"] = []string{""} }), groups},
+		"wrong attribute value":  {newUser(func(u *gocloak.User) { (*u.Attributes)["membershipStatus"] = []string{"lapsed"} }), groups},
+		"invalid schedule":       {newUser(func(u *gocloak.User) { (*u.Attributes)["hours"] = []string{"sometimes"} }), groups},
+		"missing required group": {newUser(nil), nil},
+		"excluded group":         {newUser(nil), map[string]struct{}{"waiver-signed": {}, "suspended": {}}},
+	} {
+		assert.Nil(t, r.newAccessUser(tc.user, tc.groups, time.UTC), name)
+	}
+}
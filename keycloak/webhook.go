@@ -0,0 +1,87 @@
+package keycloak
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// SignatureHeader is set by the keycloak-events plugin to the hex encoded HMAC-SHA256 of the request body,
+// using the secret the webhook was registered with.
+const SignatureHeader = "X-Keycloak-Signature"
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// VerifyWebhook reads the body of a webhook request, returning ErrInvalidSignature if it wasn't signed with the secret.
+func VerifyWebhook(r *http.Request, secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("webhook secret is not configured")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading webhook body: %w", err)
+	}
+
+	actual, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(actual, mac.Sum(nil)) {
+		return nil, ErrInvalidSignature
+	}
+	return body, nil
+}
+
+// AdminEvent is the subset of a keycloak-events admin event payload needed to tell whether it affects building access.
+type AdminEvent struct {
+	Type           string `json:"type"`           // e.g. "admin.USER-UPDATE"
+	ResourceType   string `json:"resourceType"`   // e.g. "USER", "GROUP_MEMBERSHIP", "GROUP"
+	OperationType  string `json:"operationType"`  // e.g. "CREATE", "UPDATE", "DELETE"
+	ResourcePath   string `json:"resourcePath"`   // e.g. "users/<uuid>" or "users/<uuid>/groups/<uuid>"
+	Representation string `json:"representation"` // JSON encoded resource after the change, if any
+}
+
+// UserID returns the UUID of the user the event is about, or an empty string if it isn't about a user.
+func (e *AdminEvent) UserID() string {
+	parts := strings.Split(e.ResourcePath, "/")
+	if len(parts) < 2 || parts[0] != "users" {
+		return ""
+	}
+	return parts[1]
+}
+
+// GroupID returns the UUID of the group the event is about, including group membership events.
+func (e *AdminEvent) GroupID() string {
+	parts := strings.Split(e.ResourcePath, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "groups" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// HasAttributes returns true if the user in the event's representation has any of the named attributes.
+func (e *AdminEvent) HasAttributes(names []string) bool {
+	user := &gocloak.User{}
+	if err := json.Unmarshal([]byte(e.Representation), user); err != nil || user.Attributes == nil {
+		return false
+	}
+	for _, name := range names {
+		if _, ok := (*user.Attributes)[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package keycloak
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	const body = `{"type":"admin.USER-UPDATE"}`
+
+	r := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	r.Header.Set(SignatureHeader, "2cc5d1ee2c8b4c13d6e3e5b8e8dc7796ff6abd09b5cd9d7a13e3fa48ca3d1e85")
+	_, err := VerifyWebhook(r, "secret")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	r = httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	r.Header.Set(SignatureHeader, sign(t, "secret", body))
+	actual, err := VerifyWebhook(r, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, body, string(actual))
+
+	r = httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	_, err = VerifyWebhook(r, "")
+	assert.Error(t, err)
+}
+
+func sign(t *testing.T, secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -2,89 +2,341 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	gosync "sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // the container image doesn't include a timezone database
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/TheLab-ms/access-controller-controller/client"
 	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/identity"
 	"github.com/TheLab-ms/access-controller-controller/keycloak"
+	"github.com/TheLab-ms/access-controller-controller/mqtt"
+	"github.com/TheLab-ms/access-controller-controller/notify"
 	"github.com/TheLab-ms/access-controller-controller/reporting"
 	"github.com/TheLab-ms/access-controller-controller/sync"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	conf := &conf.Env{}
 	if err := envconfig.Process("", conf); err != nil {
 		panic(err)
 	}
 
-	cli := &client.Client{
-		Addr:    conf.AccessControlHost,
-		Timeout: conf.AccessControlTimeout,
+	devices, err := conf.Controllers()
+	if err != nil {
+		log.Fatalf("invalid access controller configuration: %s", err)
 	}
-	probe := &livenessProbe{}
-
-	// Sync badge access from keycloak if configured
-	var kc *keycloak.Keycloak
-	if conf.KeycloakURL == "" {
-		log.Printf("disabling keyvault sync because keycloak URL is not set")
-	} else {
-		kc = keycloak.New(conf)
-		c := sync.NewController(conf, cli, kc)
 
-		if conf.CallbackURL != "" {
-			err := c.EnsureWebhook(ctx)
-			if err != nil {
-				log.Fatalf("error while ensuring webhook resource exists: %s", err)
-			}
+	clients := map[string]*client.Client{}
+	for _, device := range devices {
+		clients[device.Name] = &client.Client{
+			Addr:    device.Host,
+			Name:    device.Name,
+			Timeout: conf.AccessControlTimeout,
 		}
+	}
 
-		if conf.WebhookAddr != "" {
-			go func() {
-				if err := http.ListenAndServe(conf.WebhookAddr, c); err != nil {
-					log.Fatalf("error while starting webhook listener: %s", err)
-				}
-			}()
+	// Run a single command instead of the daemons if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Stdout, conf, clients, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
+	}
+
+	// Otherwise every Keycloak webhook would be rejected, which is easy to miss when upgrading
+	if conf.WebhookAddr != "" && conf.WebhookSecret == "" {
+		log.Fatalf("webhook secret must be set when webhook addr is")
+	}
+	probe := &livenessProbe{}
 
-		probe.Add(&c.LastSync)
-		go c.Run(ctx)
+	// Every long-running loop is tracked so in-flight work can finish when shutting down
+	var wg gosync.WaitGroup
+	run := func(fn func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(ctx)
+		}()
+	}
+
+	// Outbound webhooks and MQTT are stopped last, since the other loops send them events until they return
+	outputCtx, stopOutputs := context.WithCancel(context.Background())
+	defer stopOutputs()
+	var outputWG gosync.WaitGroup
+	runOutput := func(fn func(context.Context)) {
+		outputWG.Add(1)
+		go func() {
+			defer outputWG.Done()
+			fn(outputCtx)
+		}()
+	}
+
+	users, err := newIdentitySource(conf)
+	if err != nil {
+		log.Fatalf("error while configuring %s identity source: %s", conf.IdentitySource, err)
+	}
+
+	// Send events to outbound webhooks if configured
+	var notifier *notify.Notifier
+	if len(conf.OutboundWebhookURLs) > 0 {
+		if conf.OutboundWebhookSecret == "" {
+			log.Fatalf("outbound webhook secret must be set when outbound webhook URLs are")
+		}
+		notifier = notify.New(conf.OutboundWebhookURLs, conf.OutboundWebhookSecret)
+		runOutput(notifier.Run)
 	}
 
 	// Scrape badge swipes to the reporting database if configured
+	var reporter *reporting.Controller
 	if conf.SwipeScrapeInterval == 0 {
 		log.Printf("disabling reporting controller because swipe scrape interval is zero")
 	} else {
-		ctrl, err := reporting.NewController(conf, cli, kc)
+		reporter, err = reporting.NewController(conf, clients, users)
 		if err != nil {
 			log.Fatalf("error while configuring reporting controller: %s", err)
 		}
-		probe.Add(&ctrl.LastSync)
-		go ctrl.Run(ctx)
+		probe.Add(&reporter.LastSync)
+		run(reporter.Run)
+
+		if notifier != nil {
+			swipes, _ := reporter.Subscribe()
+			run(func(context.Context) { notifier.NotifySwipes(swipes) }) // returns once the reporter does
+		}
 	}
 
-	if conf.ProbeAddr != "" {
+	// Publish door activity and health to MQTT if configured
+	var publisher *mqtt.Publisher
+	if conf.MQTTBrokerURL != "" {
+		publisher = mqtt.New(conf)
+		runOutput(publisher.Run)
+
+		if reporter != nil {
+			swipes, _ := reporter.Subscribe()
+			run(func(context.Context) { publisher.PublishSwipes(swipes) })
+		}
+	}
+
+	// Sync badge access from the identity source to every access controller if configured
+	ctrls := []*sync.Controller{}
+	if users == nil {
+		log.Printf("disabling sync because keycloak URL is not set")
+	} else {
+		for _, device := range devices {
+			c := sync.NewController(conf, device.Name, clients[device.Name], users, reporter, notifier)
+			probe.Add(&c.LastSync)
+			probe.AddHealthCheck(c.Health)
+			if publisher != nil {
+				publisher.AddHealthCheck(c.Name(), func() error {
+					if err := c.Health(); err != nil {
+						return err
+					}
+					return c.LastError()
+				})
+			}
+			ctrls = append(ctrls, c)
+			run(c.Run)
+		}
+
+		if conf.CallbackURL != "" {
+			if conf.WebhookSecret == "" {
+				log.Fatalf("webhook secret must be set when callback URL is")
+			}
+			err := ctrls[0].EnsureWebhook(ctx)
+			if err != nil {
+				log.Fatalf("error while ensuring webhook resource exists: %s", err)
+			}
+		}
+	}
+
+	var shuttingDown atomic.Bool
+	servers := []*http.Server{}
+	if conf.WebhookAddr != "" {
+		// Remote opens haven't been verified against a real access controller yet, so they're opt in
+		doors := devices
+		if !conf.RemoteOpenEnabled {
+			doors = nil
+			if conf.RemoteOpenToken != "" {
+				log.Printf("remote door open is disabled until REMOTE_OPEN_ENABLED=true is set")
+			}
+		}
+		mux := newWebhookMux(doors, ctrls, reporter, conf.WebhookSecret)
+		svr := &http.Server{Addr: conf.WebhookAddr, Handler: rejectChangesDuringShutdown(mux, &shuttingDown)}
+		servers = append(servers, svr)
 		go func() {
-			http.ListenAndServe(conf.ProbeAddr, probe)
+			if err := svr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("error while starting webhook listener: %s", err)
+			}
 		}()
 	}
 
-	<-ctx.Done() // sleep forever while things run in other goroutines
+	if conf.ProbeAddr != "" {
+		svr := &http.Server{Addr: conf.ProbeAddr, Handler: probe}
+		servers = append(servers, svr)
+		go svr.ListenAndServe()
+	}
+
+	<-ctx.Done() // sleep until SIGINT or SIGTERM while things run in other goroutines
+	stop()       // a second signal kills the process right away
+	shuttingDown.Store(true)
+	log.Printf("shutting down, waiting for in-flight work to finish")
+	wg.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if notifier != nil && !notifier.Drain(shutdownCtx) {
+		log.Printf("giving up on events that haven't been sent to outbound webhooks yet")
+	}
+	stopOutputs()
+	outputWG.Wait()
+	if len(ctrls) > 0 && conf.CallbackURL != "" && conf.WebhookRemoveOnShutdown {
+		if err := ctrls[0].RemoveWebhook(shutdownCtx); err != nil {
+			log.Printf("error while removing webhook: %s", err)
+		}
+	}
+	for _, svr := range servers {
+		if err := svr.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error while shutting down server on %s: %s", svr.Addr, err)
+		}
+	}
+	if reporter != nil {
+		reporter.Close()
+	}
+	log.Printf("shut down cleanly")
+}
+
+// newIdentitySource returns the configured source of users to give access to, or nil when using Keycloak without a URL.
+func newIdentitySource(env *conf.Env) (identity.Source, error) {
+	loc, err := time.LoadLocation(env.ScheduleTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("loading schedule timezone: %w", err)
+	}
+
+	switch env.IdentitySource {
+	case "keycloak":
+		if env.KeycloakURL == "" {
+			return nil, nil
+		}
+		kc, err := keycloak.New(env)
+		if err != nil {
+			return nil, err
+		}
+		return kc, nil
+	case "file":
+		if env.RosterFile == "" {
+			return nil, errors.New("roster file must be set")
+		}
+		return identity.NewRoster(env, loc), nil
+	case "http":
+		if env.IdentityURL == "" {
+			return nil, errors.New("identity URL must be set")
+		}
+		return identity.NewHTTP(env, loc), nil
+	case "ldap":
+		if env.LDAPServerURL == "" || env.LDAPBaseDN == "" {
+			return nil, errors.New("LDAP server URL and base DN must be set")
+		}
+		return identity.NewLDAP(env, loc), nil
+	default:
+		return nil, fmt.Errorf("unknown identity source %q, expected keycloak, file, http, or ldap", env.IdentitySource)
+	}
+}
+
+// newWebhookMux routes requests for each sync controller under /<name>/ (e.g. /default/cards), keeping /cards as an
+// alias of /default/cards.
+// Webhooks from Keycloak aren't specific to any one access controller, so they trigger all of them.
+// Remote door opens (for the given access controllers), access grants, and the swipe stream are handled by the
+// reporting controller (when enabled) since they come from its database.
+func newWebhookMux(doors conf.AccessControllers, ctrls []*sync.Controller, reporter *reporting.Controller, webhookSecret string) http.Handler {
+	mux := http.NewServeMux()
+	for _, c := range ctrls {
+		prefix := "/" + c.Name()
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, c))
+		if c.Name() == conf.DefaultAccessControllerName {
+			mux.Handle("/cards", c) // served at the root before multiple access controllers were supported
+		}
+	}
+	if reporter != nil {
+		for _, device := range doors {
+			mux.Handle("/"+device.Name+"/doors/", reporter)
+		}
+
+		// Sync right away when grants change instead of waiting for the next resync
+		reporter.OnGrantChange(func() {
+			for _, c := range ctrls {
+				c.Trigger()
+			}
+		})
+		mux.Handle("/grants", reporter)
+		mux.Handle("/grants/", reporter)
+		mux.Handle("/swipes/stream", reporter)
+		mux.Handle("/swipes/stream/ticket", reporter)
+	}
+	webhook := func(w http.ResponseWriter, r *http.Request) {
+		body, err := keycloak.VerifyWebhook(r, webhookSecret)
+		if err != nil {
+			log.Printf("rejected webhook: %s", err)
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		for _, c := range ctrls {
+			c.HandleWebhook(body)
+		}
+	}
+	mux.HandleFunc("/webhook", webhook)
+	mux.HandleFunc("/webhook/", webhook)
+	return mux
+}
+
+// rejectChangesDuringShutdown responds with 503 to requests that change anything (e.g. remote opens and grants) once
+// shutdown has started, since the loops that would act on them may have already stopped.
+func rejectChangesDuringShutdown(next http.Handler, shuttingDown *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // This is a very crude probe to kick the process if the loops get stuck for some reason.
+// Conditions that need an operator's attention rather than a restart are reported separately at /healthz,
+// and Prometheus metrics are served at /metrics.
 type livenessProbe struct {
-	checks []*atomic.Pointer[time.Time]
+	checks       []*atomic.Pointer[time.Time]
+	healthChecks []func() error
 }
 
 func (l *livenessProbe) Add(ptr *atomic.Pointer[time.Time]) { l.checks = append(l.checks, ptr) }
 
+func (l *livenessProbe) AddHealthCheck(fn func() error) { l.healthChecks = append(l.healthChecks, fn) }
+
 func (l *livenessProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		l.serveHealth(w)
+		return
+	case "/metrics":
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+
 	var mostRecent time.Time
 	for _, check := range l.checks {
 		ts := check.Load()
@@ -99,3 +351,19 @@ func (l *livenessProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(200)
 }
+
+func (l *livenessProbe) serveHealth(w http.ResponseWriter) {
+	msgs := []string{}
+	for _, check := range l.healthChecks {
+		if err := check(); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+
+	if len(msgs) > 0 {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, strings.Join(msgs, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/keycloak"
+	"github.com/TheLab-ms/access-controller-controller/sync"
+)
+
+func TestWebhookMux(t *testing.T) {
+	env := &conf.Env{DebugToken: "token"}
+	ctrls := []*sync.Controller{
+		sync.NewController(env, conf.DefaultAccessControllerName, &client.Client{}, nil, nil, nil),
+		sync.NewController(env, "garage", &client.Client{}, nil, nil, nil),
+	}
+	mux := newWebhookMux(nil, ctrls, nil, "secret")
+
+	body := `{"resourceType": "GROUP_MEMBERSHIP"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	serve := func(method, path, signature string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if signature != "" {
+			r.Header.Set(keycloak.SignatureHeader, signature)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, 401, serve("POST", "/webhook", ""), "unsigned")
+	assert.Equal(t, 401, serve("POST", "/webhook", hex.EncodeToString([]byte("nope"))), "bad signature")
+	assert.Equal(t, 200, serve("POST", "/webhook", signature), "signed")
+	assert.Equal(t, 200, serve("POST", "/webhook/realm", signature), "signed with a suffix")
+
+	// Signed webhooks aren't accepted by the per-controller routes, which require the debug token
+	assert.Equal(t, 401, serve("POST", "/garage/webhook", signature))
+	assert.Equal(t, 401, serve("GET", "/cards", ""))
+}
+
+func TestRejectChangesDuringShutdown(t *testing.T) {
+	var shuttingDown atomic.Bool
+	h := rejectChangesDuringShutdown(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &shuttingDown)
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/grants", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, 200, serve("POST"))
+
+	shuttingDown.Store(true)
+	assert.Equal(t, 503, serve("POST"))
+	assert.Equal(t, 503, serve("DELETE"))
+	assert.Equal(t, 200, serve("GET"))
+}
@@ -0,0 +1,163 @@
+// Package mqtt publishes door activity and access controller health to an MQTT broker.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
+)
+
+// Health is published (retained) to <prefix>/<controller>/health whenever it changes.
+type Health struct {
+	Controller string
+	Healthy    bool
+	Error      string `json:",omitempty"`
+	Time       time.Time
+}
+
+// Publisher sends swipes to <prefix>/<controller>/swipe, remote opens to <prefix>/<controller>/remote_open,
+// and health to <prefix>/<controller>/health. <prefix>/status is "online" while connected and "offline" otherwise.
+type Publisher struct {
+	client        paho.Client
+	prefix        string
+	timeout       time.Duration
+	checkInterval time.Duration
+
+	mut          sync.Mutex
+	healthChecks map[string]func() error
+}
+
+func New(env *conf.Env) *Publisher {
+	p := &Publisher{
+		prefix:        env.MQTTTopicPrefix,
+		timeout:       time.Second * 10,
+		checkInterval: time.Second * 15,
+		healthChecks:  map[string]func() error{},
+	}
+
+	hostname, _ := os.Hostname()
+	opts := paho.NewClientOptions().
+		AddBroker(env.MQTTBrokerURL).
+		SetClientID(fmt.Sprintf("access-controller-controller-%s", hostname)).
+		SetUsername(env.MQTTUsername).
+		SetPassword(env.MQTTPassword).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetWill(p.topic("status"), "offline", 1, true).
+		SetOnConnectHandler(func(c paho.Client) {
+			log.Printf("connected to mqtt broker")
+			c.Publish(p.topic("status"), 1, true, "online")
+		}).
+		SetConnectionLostHandler(func(c paho.Client, err error) {
+			log.Printf("lost connection to mqtt broker: %s", err)
+		})
+
+	p.client = paho.NewClient(opts)
+	p.client.Connect() // retries in the background
+	return p
+}
+
+// AddHealthCheck publishes the health of the named access controller.
+func (p *Publisher) AddHealthCheck(controller string, fn func() error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.healthChecks[controller] = fn
+}
+
+// PublishSwipes publishes each swipe received from the reporting controller until the channel is closed.
+// Remote opens show up in the swipe log too, so they're published to their own topic.
+func (p *Publisher) PublishSwipes(swipes <-chan *reporting.SwipeEvent) {
+	for swipe := range swipes {
+		topic := p.topic(swipe.Controller, "swipe")
+		if swipe.Status == client.SwipeRemoteOpen {
+			topic = p.topic(swipe.Controller, "remote_open")
+		}
+		p.publish(topic, false, swipe)
+	}
+}
+
+// Run publishes changes in health until the context is canceled.
+func (p *Publisher) Run(ctx context.Context) {
+	defer func() {
+		// The broker only publishes the will when the connection is lost, not when we disconnect cleanly
+		if p.client.IsConnectionOpen() {
+			p.client.Publish(p.topic("status"), 1, true, "offline").WaitTimeout(p.timeout)
+		}
+		p.client.Disconnect(250)
+	}()
+
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+
+	last := map[string]string{}
+	for {
+		if p.client.IsConnectionOpen() { // otherwise try again once connected
+			p.publishHealth(last)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishHealth publishes the health of every access controller whose state has changed since it was last published.
+func (p *Publisher) publishHealth(last map[string]string) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for controller, check := range p.healthChecks {
+		health := &Health{Controller: controller, Healthy: true, Time: time.Now()}
+		if err := check(); err != nil {
+			health.Healthy = false
+			health.Error = err.Error()
+		}
+
+		state := fmt.Sprintf("%t %s", health.Healthy, health.Error)
+		if prev, ok := last[controller]; ok && prev == state {
+			continue
+		}
+		if p.publish(p.topic(controller, "health"), true, health) {
+			last[controller] = state
+		}
+	}
+}
+
+func (p *Publisher) publish(topic string, retained bool, msg any) bool {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("error encoding mqtt message for topic %s: %s", topic, err)
+		return false
+	}
+
+	token := p.client.Publish(topic, 1, retained, js)
+	if !token.WaitTimeout(p.timeout) {
+		log.Printf("timeout while publishing mqtt message to topic %s", topic)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("error publishing mqtt message to topic %s: %s", topic, err)
+		return false
+	}
+	return true
+}
+
+func (p *Publisher) topic(parts ...string) string {
+	topic := p.prefix
+	for _, part := range parts {
+		topic += "/" + part
+	}
+	return topic
+}
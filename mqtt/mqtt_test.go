@@ -0,0 +1,158 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
+)
+
+func TestPublisher(t *testing.T) {
+	broker := newTestBroker(t)
+
+	p := New(&conf.Env{MQTTBrokerURL: "tcp://" + broker.Addr, MQTTTopicPrefix: "space/doors"})
+	p.checkInterval = time.Millisecond * 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var healthErr error
+	p.AddHealthCheck("default", func() error { return healthErr })
+	go p.Run(ctx)
+
+	msg := broker.Next(t, "space/doors/status")
+	assert.Equal(t, "online", string(msg.Payload))
+	assert.True(t, msg.Retain)
+
+	t.Run("health", func(t *testing.T) {
+		msg := broker.Next(t, "space/doors/default/health")
+		assert.True(t, msg.Retain)
+		health := &Health{}
+		require.NoError(t, json.Unmarshal(msg.Payload, health))
+		assert.True(t, health.Healthy)
+
+		p.mut.Lock()
+		healthErr = errors.New("oops")
+		p.mut.Unlock()
+
+		msg = broker.Next(t, "space/doors/default/health")
+		require.NoError(t, json.Unmarshal(msg.Payload, health))
+		assert.False(t, health.Healthy)
+		assert.Equal(t, "oops", health.Error)
+	})
+
+	t.Run("swipes", func(t *testing.T) {
+		swipes := make(chan *reporting.SwipeEvent, 2)
+		swipes <- &reporting.SwipeEvent{Controller: "default", ID: 1, CardID: 100, DoorID: "#1DOOR", Status: client.SwipeAllowed, Name: "Some Member"}
+		swipes <- &reporting.SwipeEvent{Controller: "default", ID: 2, DoorID: "#2DOOR", Status: client.SwipeRemoteOpen}
+		close(swipes)
+		go p.PublishSwipes(swipes)
+
+		msg := broker.Next(t, "space/doors/default/swipe")
+		assert.False(t, msg.Retain)
+		swipe := &reporting.SwipeEvent{}
+		require.NoError(t, json.Unmarshal(msg.Payload, swipe))
+		assert.Equal(t, "Some Member", swipe.Name)
+
+		msg = broker.Next(t, "space/doors/default/remote_open")
+		require.NoError(t, json.Unmarshal(msg.Payload, swipe))
+		assert.Equal(t, "#2DOOR", swipe.DoorID)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		cancel()
+		msg := broker.Next(t, "space/doors/status")
+		assert.Equal(t, "offline", string(msg.Payload))
+		assert.True(t, msg.Retain)
+	})
+}
+
+// testBroker is just enough of an MQTT broker to accept a client's connection and record what it publishes.
+type testBroker struct {
+	Addr     string
+	messages chan *packets.PublishPacket
+	skipped  []*packets.PublishPacket // published to other topics than the one being waited for
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	b := &testBroker{Addr: l.Addr().String(), messages: make(chan *packets.PublishPacket, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	for {
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var resp packets.ControlPacket
+		switch p := pkt.(type) {
+		case *packets.ConnectPacket:
+			resp = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.messages <- p
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				resp = ack
+			}
+		case *packets.PingreqPacket:
+			resp = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			conn.Close()
+			return
+		}
+		if resp != nil {
+			resp.Write(conn)
+		}
+	}
+}
+
+// Next returns the next message published to the given topic.
+func (b *testBroker) Next(t *testing.T, topic string) *packets.PublishPacket {
+	for i, msg := range b.skipped {
+		if msg.TopicName == topic {
+			b.skipped = append(b.skipped[:i], b.skipped[i+1:]...)
+			return msg
+		}
+	}
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case msg := <-b.messages:
+			if msg.TopicName == topic {
+				return msg
+			}
+			b.skipped = append(b.skipped, msg)
+		case <-timeout:
+			t.Fatalf("nothing was published to %s", topic)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Package notify delivers events to outbound webhooks, signed with a shared secret and retried with backoff.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
+)
+
+// Event types
+const (
+	Swipe       = "swipe"
+	UnknownCard = "unknown_card" // sent in addition to the swipe event
+	CardAdded   = "card_added"
+	CardRemoved = "card_removed"
+	SyncFailed  = "sync_failed"
+)
+
+// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body, prefixed with "sha256=".
+const SignatureHeader = "X-Signature-256"
+
+// Event is the JSON body of every webhook request.
+type Event struct {
+	Type string
+	Time time.Time
+	Data any
+}
+
+// SyncFailure is the data of SyncFailed events.
+type SyncFailure struct {
+	Controller string
+	Error      string
+}
+
+// Notifier sends events to every configured URL. Each URL has its own queue so one slow or broken
+// receiver doesn't hold up the others. Events are dropped when a queue is full or retries are exhausted.
+type Notifier struct {
+	secret      []byte
+	client      *http.Client
+	queues      map[string]chan []byte
+	maxAttempts int
+	minBackoff  time.Duration
+	pending     sync.WaitGroup // events that are queued or being delivered
+}
+
+func New(urls []string, secret string) *Notifier {
+	n := &Notifier{
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: time.Second * 10},
+		queues:      map[string]chan []byte{},
+		maxAttempts: 8,
+		minBackoff:  time.Second,
+	}
+	for _, url := range urls {
+		n.queues[url] = make(chan []byte, 256)
+	}
+	return n
+}
+
+// Notify queues an event for delivery without waiting for it to be sent.
+func (n *Notifier) Notify(eventType string, data any) {
+	body, err := json.Marshal(&Event{Type: eventType, Time: time.Now(), Data: data})
+	if err != nil {
+		log.Printf("error encoding %s event: %s", eventType, err)
+		return
+	}
+
+	for url, queue := range n.queues {
+		n.pending.Add(1)
+		select {
+		case queue <- body:
+		default:
+			n.pending.Done()
+			log.Printf("dropping %s event for webhook %s because too many are queued", eventType, url)
+		}
+	}
+}
+
+// Run delivers queued events until the context is canceled, which abandons any that haven't been delivered yet.
+// Use Drain first to give them a chance.
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for url, queue := range n.queues {
+		wg.Add(1)
+		go func(url string, queue chan []byte) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case body := <-queue:
+					n.deliver(ctx, url, body)
+					n.pending.Done()
+				}
+			}
+		}(url, queue)
+	}
+	wg.Wait()
+}
+
+// Drain waits for every queued event to be delivered (or given up on), returning false if the context is canceled
+// first. Run must still be running, and nothing should call Notify once Drain has been called.
+func (n *Notifier) Drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (n *Notifier) deliver(ctx context.Context, url string, body []byte) {
+	backoff := n.minBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.send(ctx, url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.maxAttempts {
+			log.Printf("giving up on delivering event to webhook %s after %d attempt(s): %s", url, attempt, err)
+			return
+		}
+
+		log.Printf("error delivering event to webhook %s (will retry in %s): %s", url, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes a single delivery attempt, returning true if it's worth retrying on error.
+func (n *Notifier) send(ctx context.Context, url string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+Sign(n.secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected response status: %d with body: %s", resp.StatusCode, msg)
+	}
+	return false, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body, for receivers to compare against SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NotifySwipes sends an event for each swipe received from the reporting controller until the channel is closed.
+func (n *Notifier) NotifySwipes(swipes <-chan *reporting.SwipeEvent) {
+	for swipe := range swipes {
+		n.Notify(Swipe, swipe)
+		if swipe.Status == client.SwipeUnknownCard {
+			n.Notify(UnknownCard, swipe)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifier(t *testing.T) {
+	var attempts atomic.Int64
+	received := make(chan *Event, 10)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign([]byte("secret"), body) {
+			w.WriteHeader(401)
+			return
+		}
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(503) // fail the first couple of attempts
+			return
+		}
+
+		event := &Event{}
+		json.Unmarshal(body, event)
+		received <- event
+	}))
+	t.Cleanup(svr.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	n := New([]string{svr.URL}, "secret")
+	n.minBackoff = time.Millisecond
+	go n.Run(ctx)
+
+	n.Notify(SyncFailed, &SyncFailure{Controller: "default", Error: "oops"})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, SyncFailed, event.Type)
+		assert.Equal(t, map[string]any{"Controller": "default", "Error": "oops"}, event.Data)
+	case <-time.After(time.Second * 5):
+		t.Fatal("event was never delivered")
+	}
+	assert.Equal(t, int64(3), attempts.Load())
+}
+
+func TestNotifierDrain(t *testing.T) {
+	release := make(chan struct{})
+	var delivered atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		delivered.Add(1)
+	}))
+	t.Cleanup(svr.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	n := New([]string{svr.URL}, "secret")
+	go n.Run(ctx)
+	for i := 0; i < 3; i++ {
+		n.Notify(CardRemoved, i)
+	}
+
+	// Events are still being delivered
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancelTimeout()
+	assert.False(t, n.Drain(timeout))
+
+	close(release)
+	assert.True(t, n.Drain(context.Background()))
+	assert.Equal(t, int64(3), delivered.Load())
+}
+
+func TestNotifierGivesUp(t *testing.T) {
+	n := New(nil, "wrong")
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(400)
+	}))
+	t.Cleanup(svr.Close)
+
+	retry, err := n.send(context.Background(), svr.URL, []byte("{}"))
+	require.Error(t, err)
+	assert.False(t, retry) // client errors won't succeed on retry
+
+	n.minBackoff = time.Millisecond
+	n.deliver(context.Background(), svr.URL, []byte("{}"))
+	assert.Equal(t, int64(2), attempts.Load())
+}
@@ -0,0 +1,42 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	CardAdded    = "add"
+	CardRemoved  = "remove"
+	CardConflict = "conflict" // the fob number was already in use when adding
+)
+
+// CardChange is a change made to an access controller's cards by the sync controller.
+type CardChange struct {
+	Controller string
+	Action     string
+	UserUUID   string // empty when the card doesn't belong to a known user
+	FobNumber  int
+	CardID     int // zero when unknown
+	Reason     string
+	Time       time.Time
+}
+
+// RecordCardChange writes a card change to the audit log.
+func (c *Controller) RecordCardChange(ctx context.Context, change *CardChange) error {
+	_, err := c.db.Exec(ctx, "INSERT INTO card_changes (controller, action, userUUID, fobNumber, cardID, reason, time) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		change.Controller, change.Action, nullIfZero(change.UserUUID), change.FobNumber, nullIfZero(change.CardID), change.Reason, change.Time)
+	if err != nil {
+		return fmt.Errorf("inserting card change into database: %w", err)
+	}
+	return nil
+}
+
+func nullIfZero[T comparable](val T) *T {
+	var zero T
+	if val == zero {
+		return nil
+	}
+	return &val
+}
@@ -2,19 +2,19 @@ package reporting
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/jackc/pgx"
 	"github.com/jackc/pgx/v4/pgxpool"
 
 	"github.com/TheLab-ms/access-controller-controller/client"
 	"github.com/TheLab-ms/access-controller-controller/conf"
-	"github.com/TheLab-ms/access-controller-controller/keycloak"
+	"github.com/TheLab-ms/access-controller-controller/identity"
 )
 
 const migration = `
@@ -28,20 +28,90 @@ CREATE TABLE IF NOT EXISTS swipes (
 
 ALTER TABLE swipes ADD COLUMN IF NOT EXISTS seenAt timestamp;
 
+-- Swipe IDs are only unique per access controller
+ALTER TABLE swipes ADD COLUMN IF NOT EXISTS controller text not null default 'default';
+ALTER TABLE swipes DROP CONSTRAINT IF EXISTS swipes_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_swipes_controller_id ON swipes (controller, id);
+
+ALTER TABLE swipes ADD COLUMN IF NOT EXISTS status text;
+ALTER TABLE swipes ADD COLUMN IF NOT EXISTS rawStatus text;
+
 CREATE INDEX IF NOT EXISTS idx_swipes_cardID ON swipes (cardID);
 CREATE INDEX IF NOT EXISTS idx_swipes_time ON swipes (time);
+
+-- Entries in the swipe log that aren't swipes, like reboots
+CREATE TABLE IF NOT EXISTS controller_events (
+	controller text not null,
+	id integer not null,
+	event text not null,
+	rawStatus text not null,
+	time timestamp not null,
+	seenAt timestamp not null,
+	primary key (controller, id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_controller_events_time ON controller_events (time);
+
+CREATE TABLE IF NOT EXISTS remote_opens (
+	id serial primary key,
+	controller text not null,
+	doorID text not null,
+	requestedBy text not null,
+	time timestamp not null,
+	error text
+);
+
+CREATE INDEX IF NOT EXISTS idx_remote_opens_time ON remote_opens (time);
+
+CREATE TABLE IF NOT EXISTS card_changes (
+	id serial primary key,
+	controller text not null,
+	action text not null,
+	userUUID text,
+	fobNumber integer not null,
+	cardID integer,
+	reason text not null,
+	time timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_card_changes_userUUID ON card_changes (userUUID);
+CREATE INDEX IF NOT EXISTS idx_card_changes_fobNumber ON card_changes (fobNumber);
+CREATE INDEX IF NOT EXISTS idx_card_changes_time ON card_changes (time);
+
+CREATE TABLE IF NOT EXISTS access_grants (
+	id text primary key,
+	fobNumber integer not null,
+	name text not null,
+	expiresAt timestamptz not null,
+	createdBy text not null,
+	createdAt timestamptz not null
+);
 `
 
 type Controller struct {
 	LastSync atomic.Pointer[time.Time]
 
 	db                  *pgxpool.Pool
-	client              *client.Client
-	keycloak            *keycloak.Keycloak
+	clients             map[string]*client.Client
+	users               identity.Source // optional, used to resolve the names of swipes
 	swipeScrapeInterval time.Duration
+	verboseScrapes      bool // logging every scrape is too noisy when fast polling
+	remoteOpenToken     string
+	grantToken          string
+	grantHooks          []func() // called when grants change
+	streamToken         string
+
+	subsMut    sync.Mutex
+	subs       map[chan *SwipeEvent]struct{}
+	subsClosed bool // set once Run returns
+
+	ticketsMut sync.Mutex
+	tickets    map[string]time.Time // single use swipe stream tokens and when they expire
 }
 
-func NewController(env *conf.Env, ac *client.Client, kc *keycloak.Keycloak) (*Controller, error) {
+// NewController creates a reporting controller that scrapes each of the given access controllers, keyed by name.
+// Swipes are attributed to users from the identity source when it isn't nil.
+func NewController(env *conf.Env, acs map[string]*client.Client, users identity.Source) (*Controller, error) {
 	db, err := pgxpool.Connect(context.Background(), fmt.Sprintf("user=%s password=%s host=%s port=5432 dbname=postgres", env.PostgresUser, env.PostgresPassword, env.PostgresHost))
 	if err != nil {
 		return nil, fmt.Errorf("constructing db client: %w", err)
@@ -52,55 +122,120 @@ func NewController(env *conf.Env, ac *client.Client, kc *keycloak.Keycloak) (*Co
 		return nil, fmt.Errorf("db migration: %w", err)
 	}
 
-	return &Controller{
+	c := &Controller{
 		db:                  db,
-		client:              ac,
-		keycloak:            kc,
+		clients:             acs,
+		users:               users,
 		swipeScrapeInterval: env.SwipeScrapeInterval,
-	}, nil
+		verboseScrapes:      true,
+		remoteOpenToken:     env.RemoteOpenToken,
+		grantToken:          env.GrantToken,
+		streamToken:         env.SwipeStreamToken,
+	}
+	if env.SwipeFastPollInterval != 0 {
+		c.swipeScrapeInterval = env.SwipeFastPollInterval
+		c.verboseScrapes = false
+	}
+	return c, nil
+}
+
+// ServeHTTP serves the remote open, access grant, and swipe stream APIs.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/grants" || strings.HasPrefix(r.URL.Path, "/grants/") {
+		c.serveGrants(w, r)
+		return
+	}
+	if r.URL.Path == "/swipes/stream" {
+		c.serveSwipeStream(w, r)
+		return
+	}
+	if r.URL.Path == "/swipes/stream/ticket" {
+		c.serveStreamTicket(w, r)
+		return
+	}
+	c.serveRemoteOpen(w, r)
 }
 
 func (c *Controller) Run(ctx context.Context) {
-	runLoop(c.swipeScrapeInterval, func() bool {
-		err := c.scrape(ctx)
-		if err != nil {
-			log.Printf("error scraping swipe events: %s", err)
-		}
-		now := time.Now()
-		c.LastSync.Store(&now)
-		return err == nil
-	})
+	// Each access controller is scraped independently so one being unreachable doesn't hold up the others
+	var wg sync.WaitGroup
+	for name, cli := range c.clients {
+		wg.Add(1)
+		go func(name string, cli *client.Client) {
+			defer wg.Done()
+			runLoop(ctx, c.swipeScrapeInterval, func() bool {
+				err := c.scrape(ctx, name, cli)
+				if err != nil {
+					log.Printf("error scraping swipe events from controller %s: %s", name, err)
+				}
+				now := time.Now()
+				c.LastSync.Store(&now)
+				return err == nil
+			})
+		}(name, cli)
+	}
+	wg.Wait()
+	c.endSubscriptions() // no more swipes are coming
 }
 
-func (c *Controller) scrape(ctx context.Context) error {
+// Close closes the database pool. Call it once Run has returned and the HTTP servers have stopped.
+func (c *Controller) Close() { c.db.Close() }
+
+func (c *Controller) scrape(ctx context.Context, controller string, cli *client.Client) error {
 	start := time.Now()
-	log.Printf("starting to scrape swipe events")
-	defer log.Printf("finished scraping swipe events in %s", time.Since(start))
+	if c.verboseScrapes {
+		log.Printf("starting to scrape swipe events from controller %s", controller)
+		defer func() {
+			log.Printf("finished scraping swipe events from controller %s in %s", controller, time.Since(start))
+		}()
+	}
 
+	// Both tables share the swipe log's IDs
 	var queryStart int64
-	err := c.db.QueryRow(context.Background(), "SELECT id FROM swipes ORDER BY id DESC LIMIT 1").Scan(&queryStart)
-	if errors.Is(err, pgx.ErrNoRows) {
-		queryStart = -1
-		err = nil
-	}
+	err := c.db.QueryRow(context.Background(), "SELECT COALESCE(GREATEST((SELECT max(id) FROM swipes WHERE controller = $1), (SELECT max(id) FROM controller_events WHERE controller = $1)), -1)", controller).Scan(&queryStart)
 	if err != nil {
 		return fmt.Errorf("finding cursor position: %s", err)
 	}
-	log.Printf("last known swipe event ID: %d", queryStart)
+	if c.verboseScrapes {
+		log.Printf("last known swipe event ID: %d", queryStart)
+	}
 
-	usersByUUID := map[string]*keycloak.AccessUser{}
-	if c.keycloak != nil {
-		allUsers, err := c.keycloak.ListUsers(ctx)
-		if err != nil {
-			return fmt.Errorf("listing users from Keycloak: %w", err)
+	// Listing users can take many requests, so only do it once there's a new swipe to attribute
+	var usersByUUID map[string]*identity.AccessUser
+	// Swipes are listed newest first, so publish them in reverse once we're done.
+	// The initial import of the whole log isn't worth publishing.
+	newSwipes := []*SwipeEvent{}
+	defer func() {
+		if queryStart == -1 {
+			return
 		}
-		for _, user := range allUsers {
-			uuid := strings.ReplaceAll(user.UUID, "-", "") // remove dashes since we don't store them in access controller
-			usersByUUID[uuid] = user
+		for i, j := 0, len(newSwipes)-1; i < j; i, j = i+1, j-1 {
+			newSwipes[i], newSwipes[j] = newSwipes[j], newSwipes[i]
 		}
-	}
+		c.publish(newSwipes)
+	}()
 
+	// ...which also means the first one is the head of the log
+	head := queryStart
 	fn := func(swipe *client.CardSwipe) error {
+		if int64(swipe.ID) > head {
+			head = int64(swipe.ID)
+			swipeLogHead.WithLabelValues(controller).Set(float64(head))
+			swipeScrapeLag.WithLabelValues(controller).Set(float64(head - queryStart))
+		}
+
+		if swipe.Status == client.SwipeReboot {
+			return c.recordControllerEvent(ctx, controller, swipe)
+		}
+
+		if usersByUUID == nil {
+			users, err := c.listUsersByUUID(ctx)
+			if err != nil {
+				return err
+			}
+			usersByUUID = users
+		}
+
 		var name string
 		if user := usersByUUID[swipe.Name]; user != nil {
 			name = user.Name
@@ -108,24 +243,76 @@ func (c *Controller) scrape(ctx context.Context) error {
 			name = swipe.Name // fall back to UUID
 		}
 
-		_, err := c.db.Exec(ctx, "INSERT INTO swipes (id, cardID, doorID, time, name, seenAt) VALUES ($1, $2, $3, $4, $5, NOW()) ON CONFLICT DO NOTHING", swipe.ID, swipe.CardID, swipe.DoorID, swipe.Time, name)
+		tag, err := c.db.Exec(ctx, "INSERT INTO swipes (controller, id, cardID, doorID, status, rawStatus, time, name, seenAt) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW()) ON CONFLICT DO NOTHING", controller, swipe.ID, swipe.CardID, swipe.DoorID, string(swipe.Status), swipe.RawStatus, swipe.Time, name)
 		if err != nil {
 			return fmt.Errorf("inserting swipe %d into database: %s", swipe.ID, err)
 		}
+		if tag.RowsAffected() > 0 {
+			newSwipes = append(newSwipes, &SwipeEvent{
+				Controller: controller,
+				ID:         swipe.ID,
+				CardID:     swipe.CardID,
+				DoorID:     swipe.DoorID,
+				Status:     swipe.Status,
+				Name:       name,
+				Time:       swipe.Time,
+			})
+		}
 
-		log.Printf("inserted swipe event %d into database - card=%d door=%s time=%s", swipe.ID, swipe.CardID, swipe.DoorID, swipe.Time)
+		log.Printf("inserted swipe event %d into database - controller=%s card=%d door=%s status=%s time=%s", swipe.ID, controller, swipe.CardID, swipe.DoorID, swipe.Status, swipe.Time)
 		return nil
 	}
 
-	return c.client.ListSwipes(ctx, int(queryStart), fn)
+	if err := cli.ListSwipes(ctx, int(queryStart), fn); err != nil {
+		return err
+	}
+	if head == queryStart && head >= 0 {
+		swipeLogHead.WithLabelValues(controller).Set(float64(head))
+		swipeScrapeLag.WithLabelValues(controller).Set(0)
+	}
+	return c.updateLastRebootTime(ctx, controller)
+}
+
+// listUsersByUUID returns the users from the identity source and grants, keyed by UUID without dashes like the
+// names of their cards.
+func (c *Controller) listUsersByUUID(ctx context.Context) (map[string]*identity.AccessUser, error) {
+	usersByUUID := map[string]*identity.AccessUser{}
+	if c.users != nil {
+		allUsers, err := c.users.ListUsers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing users: %w", err)
+		}
+		for _, user := range allUsers {
+			uuid := strings.ReplaceAll(user.UUID, "-", "") // remove dashes since we don't store them in access controller
+			usersByUUID[uuid] = user
+		}
+	}
+
+	grants, err := c.ListGrants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, grant := range grants {
+		user := grant.AccessUser()
+		usersByUUID[strings.ReplaceAll(user.UUID, "-", "")] = user
+	}
+	return usersByUUID, nil
 }
 
-func runLoop(interval time.Duration, fn func() bool) {
+// runLoop calls fn every interval, backing off while it fails, until the context is canceled.
+func runLoop(ctx context.Context, interval time.Duration, fn func() bool) {
 	var lastRetry time.Duration
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 		if fn() {
 			lastRetry = 0
-			time.Sleep(interval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
 			continue
 		}
 
@@ -136,6 +323,10 @@ func runLoop(interval time.Duration, fn func() bool) {
 		if lastRetry > time.Hour {
 			lastRetry = time.Hour
 		}
-		time.Sleep(lastRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lastRetry):
+		}
 	}
 }
@@ -0,0 +1,74 @@
+package reporting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/TheLab-ms/access-controller-controller/auth"
+)
+
+var ErrUnknownController = errors.New("unknown access controller")
+
+// OpenDoor remotely opens a door on the named access controller and records the attempt alongside the swipes.
+func (c *Controller) OpenDoor(ctx context.Context, controller string, door int, requestedBy string) error {
+	cli := c.clients[controller]
+	if cli == nil {
+		return ErrUnknownController
+	}
+
+	openErr := cli.OpenDoor(ctx, door)
+
+	var errMsg string
+	if openErr != nil {
+		errMsg = openErr.Error()
+	}
+	_, err := c.db.Exec(ctx, "INSERT INTO remote_opens (controller, doorID, requestedBy, time, error) VALUES ($1, $2, $3, NOW(), $4)", controller, fmt.Sprintf("#%dDOOR", door), requestedBy, nullIfZero(errMsg))
+	if err != nil {
+		log.Printf("error recording remote open of door %d on controller %s: %s", door, controller, err)
+	}
+
+	if openErr != nil {
+		return fmt.Errorf("opening door: %w", openErr)
+	}
+	log.Printf("remotely opened door %d on controller %s at the request of %q", door, controller, requestedBy)
+	return nil
+}
+
+// serveRemoteOpen handles POST /<controller>/doors/<door>/open requests authenticated by the remote open token.
+// The optional requestedBy form value is recorded with the event.
+func (c *Controller) serveRemoteOpen(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[1] != "doors" || parts[3] != "open" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !auth.Bearer(w, r, c.remoteOpenToken, "remote open") {
+		return
+	}
+
+	door, err := strconv.Atoi(parts[2])
+	if err != nil || door < 1 {
+		http.Error(w, "invalid door number", 400)
+		return
+	}
+
+	err = c.OpenDoor(r.Context(), parts[0], door, r.FormValue("requestedBy"))
+	if errors.Is(err, ErrUnknownController) {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,41 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+)
+
+const ControllerRebooted = "reboot"
+
+// recordControllerEvent stores a non-swipe entry from the swipe log, like a reboot, in the controller_events table.
+func (c *Controller) recordControllerEvent(ctx context.Context, controller string, swipe *client.CardSwipe) error {
+	tag, err := c.db.Exec(ctx, "INSERT INTO controller_events (controller, id, event, rawStatus, time, seenAt) VALUES ($1, $2, $3, $4, $5, NOW()) ON CONFLICT DO NOTHING",
+		controller, swipe.ID, ControllerRebooted, swipe.RawStatus, swipe.Time)
+	if err != nil {
+		return fmt.Errorf("inserting controller event %d into database: %w", swipe.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil // already recorded by a previous scrape
+	}
+
+	rebootsTotal.WithLabelValues(controller).Inc()
+	log.Printf("inserted controller event %d into database - controller=%s event=%s time=%s", swipe.ID, controller, ControllerRebooted, swipe.Time)
+	return nil
+}
+
+// updateLastRebootTime sets the last reboot metric from the database, so it's accurate even after restarts.
+func (c *Controller) updateLastRebootTime(ctx context.Context, controller string) error {
+	var last *time.Time
+	err := c.db.QueryRow(ctx, "SELECT max(time) FROM controller_events WHERE controller = $1 AND event = $2", controller, ControllerRebooted).Scan(&last)
+	if err != nil {
+		return fmt.Errorf("finding last reboot time: %w", err)
+	}
+	if last != nil {
+		lastRebootTime.WithLabelValues(controller).Set(float64(last.Unix()))
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package reporting
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/auth"
+	"github.com/TheLab-ms/access-controller-controller/identity"
+)
+
+// Grant gives temporary access to someone who isn't in the identity source, like a contractor or guest.
+type Grant struct {
+	ID        string // uuid, which is used as the card name just like user IDs
+	FobNumber int
+	Name      string
+	ExpiresAt time.Time
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// AccessUser represents the grant as a user so it can be synced alongside the identity source's users.
+func (g *Grant) AccessUser() *identity.AccessUser {
+	return &identity.AccessUser{
+		UUID:          g.ID,
+		Name:          g.Name,
+		KeyfobNumbers: []int{g.FobNumber},
+		ExpiresAt:     g.ExpiresAt,
+		CreatedAt:     g.CreatedAt,
+	}
+}
+
+// CreateGrant stores a new grant, assigning its ID and creation time.
+func (c *Controller) CreateGrant(ctx context.Context, grant *Grant) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	grant.ID = id
+	grant.CreatedAt = time.Now()
+
+	_, err = c.db.Exec(ctx, "INSERT INTO access_grants (id, fobNumber, name, expiresAt, createdBy, createdAt) VALUES ($1, $2, $3, $4, $5, $6)",
+		grant.ID, grant.FobNumber, grant.Name, grant.ExpiresAt, grant.CreatedBy, grant.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("inserting grant into database: %w", err)
+	}
+	return nil
+}
+
+// ExpireGrant revokes a grant by moving its expiration to the current time. It's kept around for the record.
+func (c *Controller) ExpireGrant(ctx context.Context, id string) error {
+	tag, err := c.db.Exec(ctx, "UPDATE access_grants SET expiresAt = NOW() WHERE id = $1 AND expiresAt > NOW()", id)
+	if err != nil {
+		return fmt.Errorf("updating grant: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrGrantNotFound
+	}
+	return nil
+}
+
+var ErrGrantNotFound = errors.New("grant not found or already expired")
+
+// grantRetention is how long expired grants are still listed, which is long enough for sync to remove their cards
+// with the expiration as the reason. Older grants stay in the table for the record.
+const grantRetention = time.Hour * 24
+
+// ListGrants returns the grants that haven't expired, along with those that expired within grantRetention.
+func (c *Controller) ListGrants(ctx context.Context) ([]*Grant, error) {
+	rows, err := c.db.Query(ctx, "SELECT id, fobNumber, name, expiresAt, createdBy, createdAt FROM access_grants WHERE expiresAt > $1 ORDER BY createdAt", time.Now().Add(-grantRetention))
+	if err != nil {
+		return nil, fmt.Errorf("listing grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		grant := &Grant{}
+		if err := rows.Scan(&grant.ID, &grant.FobNumber, &grant.Name, &grant.ExpiresAt, &grant.CreatedBy, &grant.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning grant: %w", err)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// OnGrantChange calls fn whenever a grant is created or revoked through the API, e.g. to sync right away.
+// It must be called before serving requests.
+func (c *Controller) OnGrantChange(fn func()) { c.grantHooks = append(c.grantHooks, fn) }
+
+func (c *Controller) grantChanged() {
+	for _, fn := range c.grantHooks {
+		fn()
+	}
+}
+
+type grantRequest struct {
+	FobNumber int
+	Name      string
+	ExpiresAt time.Time // either this or Duration is required
+	Duration  string    // e.g. "24h"
+	CreatedBy string
+}
+
+// serveGrants handles GET /grants, POST /grants, and DELETE /grants/<id> requests authenticated by the grant token.
+func (c *Controller) serveGrants(w http.ResponseWriter, r *http.Request) {
+	if !auth.Bearer(w, r, c.grantToken, "access grants") {
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/grants"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		grants, err := c.ListGrants(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(&grants)
+
+	case id == "" && r.Method == http.MethodPost:
+		req := &grantRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), 400)
+			return
+		}
+		grant, err := req.toGrant(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := c.CreateGrant(r.Context(), grant); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("created access grant %s for fob %d (%s) expiring at %s", grant.ID, grant.FobNumber, grant.Name, grant.ExpiresAt)
+		c.grantChanged()
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(grant)
+
+	case id != "" && r.Method == http.MethodDelete:
+		err := c.ExpireGrant(r.Context(), id)
+		if errors.Is(err, ErrGrantNotFound) {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("expired access grant %s", id)
+		c.grantChanged()
+		w.WriteHeader(204)
+
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (g *grantRequest) toGrant(now time.Time) (*Grant, error) {
+	if g.FobNumber <= 0 {
+		return nil, errors.New("a fob number is required")
+	}
+	if g.Name == "" {
+		return nil, errors.New("a name is required")
+	}
+
+	expiresAt := g.ExpiresAt
+	if g.Duration != "" {
+		d, err := time.ParseDuration(g.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration: %w", err)
+		}
+		expiresAt = now.Add(d)
+	}
+	if !expiresAt.After(now) {
+		return nil, errors.New("an expiration time in the future (or duration) is required")
+	}
+
+	return &Grant{FobNumber: g.FobNumber, Name: g.Name, ExpiresAt: expiresAt, CreatedBy: g.CreatedBy}, nil
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
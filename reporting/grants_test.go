@@ -0,0 +1,32 @@
+package reporting
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantsRejectedRequests(t *testing.T) {
+	c := &Controller{grantToken: "secret"}
+	var changes int
+	c.OnGrantChange(func() { changes++ })
+
+	serve := func(method, path, body, token string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Nothing changed, so nothing should be synced
+	assert.Equal(t, 401, serve("POST", "/grants", `{"FobNumber": 123, "Name": "Guest", "Duration": "1h"}`, ""))
+	assert.Equal(t, 401, serve("DELETE", "/grants/some-id", "", "wrong"))
+	assert.Equal(t, 400, serve("POST", "/grants", `{"Name": "Guest", "Duration": "1h"}`, "secret"))
+	assert.Equal(t, 405, serve("PUT", "/grants", "", "secret"))
+	assert.Zero(t, changes)
+}
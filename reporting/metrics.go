@@ -0,0 +1,28 @@
+package reporting
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rebootsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_controller_reboots_total",
+		Help: "Reboots found in the access controller's swipe log since this process started.",
+	}, []string{"controller"})
+
+	lastRebootTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "access_controller_last_reboot_timestamp_seconds",
+		Help: "Time of the most recent reboot found in the access controller's swipe log.",
+	}, []string{"controller"})
+
+	swipeScrapeLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "access_controller_swipe_scrape_lag",
+		Help: "Entries in the swipe log that hadn't been scraped yet when the last scrape started (device head ID minus the last stored ID).",
+	}, []string{"controller"})
+
+	swipeLogHead = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "access_controller_swipe_log_head_id",
+		Help: "ID of the newest entry in the access controller's swipe log as of the last scrape.",
+	}, []string{"controller"})
+)
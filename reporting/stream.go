@@ -0,0 +1,183 @@
+package reporting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/auth"
+	"github.com/TheLab-ms/access-controller-controller/client"
+)
+
+// SwipeEvent is a newly scraped swipe, as pushed to stream subscribers.
+type SwipeEvent struct {
+	Controller string
+	ID         int
+	CardID     int
+	DoorID     string
+	Status     client.SwipeStatus
+	Name       string // resolved from the identity source or access grants when possible
+	Time       time.Time
+}
+
+// Subscribe returns a channel that receives every new swipe as it's scraped, and a function to stop receiving them.
+// Events are dropped rather than holding up scraping when a subscriber falls behind.
+func (c *Controller) Subscribe() (<-chan *SwipeEvent, func()) {
+	ch := make(chan *SwipeEvent, 64)
+
+	c.subsMut.Lock()
+	defer c.subsMut.Unlock()
+	if c.subsClosed {
+		close(ch)
+		return ch, func() {}
+	}
+	if c.subs == nil {
+		c.subs = map[chan *SwipeEvent]struct{}{}
+	}
+	c.subs[ch] = struct{}{}
+
+	return ch, func() {
+		c.subsMut.Lock()
+		defer c.subsMut.Unlock()
+		if _, ok := c.subs[ch]; ok {
+			delete(c.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends events to every subscriber in the given order.
+func (c *Controller) publish(events []*SwipeEvent) {
+	c.subsMut.Lock()
+	defer c.subsMut.Unlock()
+
+	for _, event := range events {
+		for ch := range c.subs {
+			select {
+			case ch <- event:
+			default:
+				log.Printf("dropping swipe event %d for a slow stream subscriber", event.ID)
+			}
+		}
+	}
+}
+
+// endSubscriptions closes every subscriber's channel, and the channels of any later subscribers.
+func (c *Controller) endSubscriptions() {
+	c.subsMut.Lock()
+	defer c.subsMut.Unlock()
+
+	for ch := range c.subs {
+		close(ch)
+	}
+	c.subs = nil
+	c.subsClosed = true
+}
+
+// ticketTTL is how long a swipe stream ticket can be used for.
+const ticketTTL = time.Minute
+
+// serveStreamTicket handles POST /swipes/stream/ticket, returning a single use token for the swipe stream that
+// expires after ticketTTL. Browsers' EventSource can't set headers, so tickets are passed as ?ticket= instead, which
+// ends up in access logs. That's why the stream token itself is only accepted in the header.
+func (c *Controller) serveStreamTicket(w http.ResponseWriter, r *http.Request) {
+	if !auth.Bearer(w, r, c.streamToken, "swipe stream") {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	ticket := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(ticketTTL)
+
+	c.ticketsMut.Lock()
+	now := time.Now()
+	for t, exp := range c.tickets {
+		if !now.Before(exp) {
+			delete(c.tickets, t) // expired without being used
+		}
+	}
+	if c.tickets == nil {
+		c.tickets = map[string]time.Time{}
+	}
+	c.tickets[ticket] = expiresAt
+	c.ticketsMut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"Ticket": ticket, "ExpiresAt": expiresAt})
+}
+
+// redeemTicket returns true if the ticket was issued and hasn't expired or been used yet.
+func (c *Controller) redeemTicket(ticket string) bool {
+	c.ticketsMut.Lock()
+	defer c.ticketsMut.Unlock()
+
+	expiresAt, ok := c.tickets[ticket]
+	delete(c.tickets, ticket)
+	return ok && time.Now().Before(expiresAt)
+}
+
+// serveSwipeStream pushes swipes to the client as server-sent events until it disconnects.
+func (c *Controller) serveSwipeStream(w http.ResponseWriter, r *http.Request) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		if !c.redeemTicket(ticket) {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+	} else if !auth.Bearer(w, r, c.streamToken, "swipe stream") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", 500)
+		return
+	}
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	// Keep idle connections from being closed by proxies
+	keepalive := time.NewTicker(time.Second * 30)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			js, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("error encoding swipe event: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: swipe\nid: %s/%d\ndata: %s\n\n", event.Controller, event.ID, js)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,124 @@
+package reporting
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+)
+
+func TestSwipeStream(t *testing.T) {
+	c := &Controller{streamToken: "secret"}
+	svr := httptest.NewServer(c)
+	t.Cleanup(svr.Close)
+
+	get := func(t *testing.T, method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, svr.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	ticket := func(t *testing.T) string {
+		resp := get(t, "POST", "/swipes/stream/ticket", "secret")
+		defer resp.Body.Close()
+		require.Equal(t, 200, resp.StatusCode)
+		body := struct{ Ticket string }{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Ticket
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, resp := range []*http.Response{
+			get(t, "GET", "/swipes/stream", "wrong"),
+			get(t, "GET", "/swipes/stream?token=secret", ""), // the token would end up in access logs
+			get(t, "GET", "/swipes/stream?ticket=made-up", ""),
+			get(t, "POST", "/swipes/stream/ticket", "wrong"),
+		} {
+			resp.Body.Close()
+			assert.Equal(t, 401, resp.StatusCode)
+		}
+	})
+
+	t.Run("used ticket", func(t *testing.T) {
+		used := ticket(t)
+		c.redeemTicket(used)
+		resp := get(t, "GET", "/swipes/stream?ticket="+used, "")
+		resp.Body.Close()
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		resp := get(t, "GET", "/swipes/stream?ticket="+ticket(t), "")
+		defer resp.Body.Close()
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// Wait for the handler to subscribe before publishing
+		require.Eventually(t, func() bool {
+			c.subsMut.Lock()
+			defer c.subsMut.Unlock()
+			return len(c.subs) == 1
+		}, time.Second, time.Millisecond*10)
+
+		ts := time.Date(2023, 6, 19, 14, 36, 0, 0, time.UTC)
+		c.publish([]*SwipeEvent{
+			{Controller: "default", ID: 1, CardID: 100, DoorID: "#1DOOR", Status: client.SwipeAllowed, Name: "Some Member", Time: ts},
+			{Controller: "default", ID: 2, CardID: 200, DoorID: "#1DOOR", Status: client.SwipeUnknownCard, Time: ts},
+		})
+
+		scanner := bufio.NewScanner(resp.Body)
+		lines := []string{}
+		for len(lines) < 8 && scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		assert.Equal(t, []string{
+			"event: swipe",
+			"id: default/1",
+			`data: {"Controller":"default","ID":1,"CardID":100,"DoorID":"#1DOOR","Status":"allowed","Name":"Some Member","Time":"2023-06-19T14:36:00Z"}`,
+			"",
+			"event: swipe",
+			"id: default/2",
+			`data: {"Controller":"default","ID":2,"CardID":200,"DoorID":"#1DOOR","Status":"unknown_card","Name":"","Time":"2023-06-19T14:36:00Z"}`,
+			"",
+		}, lines)
+	})
+
+	t.Run("unsubscribe on disconnect", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			c.subsMut.Lock()
+			defer c.subsMut.Unlock()
+			return len(c.subs) == 0
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("end on shutdown", func(t *testing.T) {
+		resp := get(t, "GET", "/swipes/stream", "secret")
+		defer resp.Body.Close()
+
+		require.Eventually(t, func() bool {
+			c.subsMut.Lock()
+			defer c.subsMut.Unlock()
+			return len(c.subs) == 1
+		}, time.Second, time.Millisecond*10)
+		c.endSubscriptions()
+
+		_, err := io.ReadAll(resp.Body) // returns once the handler does
+		require.NoError(t, err)
+
+		events, _ := c.Subscribe()
+		_, ok := <-events
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,208 @@
+// Package schedule parses and evaluates weekly access windows like "Mon-Fri 17:00-22:00; Sat,Sun 09:00-21:00".
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of weekly windows during which access is allowed.
+type Schedule struct {
+	windows []*window
+	loc     *time.Location
+}
+
+type window struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes since midnight - when end <= start the window continues into the next day
+}
+
+// Parse parses a semicolon-separated list of windows, each consisting of days and a time range.
+// Days are comma-separated names or ranges (e.g. "Mon-Fri", "Sat,Sun", "Daily").
+// Times are 24 hour local times in the given location (e.g. "17:00-22:00", "20:00-02:00").
+func Parse(s string, loc *time.Location) (*Schedule, error) {
+	sched := &Schedule{loc: loc}
+	for _, chunk := range strings.Split(s, ";") {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+
+		fields := strings.Fields(chunk)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid window %q, expected days and times e.g. \"Mon-Fri 17:00-22:00\"", chunk)
+		}
+
+		w := &window{}
+		if err := w.parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid days in window %q: %w", chunk, err)
+		}
+		if err := w.parseTimes(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid times in window %q: %w", chunk, err)
+		}
+		sched.windows = append(sched.windows, w)
+	}
+
+	if len(sched.windows) == 0 {
+		return nil, errors.New("schedule has no windows")
+	}
+	return sched, nil
+}
+
+func (w *window) parseDays(s string) error {
+	if strings.EqualFold(s, "daily") {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+
+		// Ranges can wrap around the end of the week e.g. Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (w *window) parseTimes(s string) (err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("expected a range like 17:00-22:00, got %q", s)
+	}
+	if w.start, err = parseMinutes(from); err != nil {
+		return err
+	}
+	if w.end, err = parseMinutes(to); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return errors.New("window is empty")
+	}
+	return nil
+}
+
+func parseMinutes(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hh)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(mm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Active returns true when t falls within one of the schedule's windows.
+func (s *Schedule) Active(t time.Time) bool {
+	lt := t.In(s.loc)
+	minute := lt.Hour()*60 + lt.Minute()
+	day := lt.Weekday()
+	yesterday := (day + 6) % 7
+
+	for _, w := range s.windows {
+		if w.end > w.start {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+
+		// Overnight windows belong to the day they start on
+		if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first time after t at which the schedule becomes active or inactive.
+// The zero value is returned if the schedule never changes.
+func (s *Schedule) Next(t time.Time) time.Time {
+	lt := t.In(s.loc)
+	midnight := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, s.loc)
+
+	// Every window edge in the coming week (plus yesterday to catch overnight windows)
+	edges := []time.Time{}
+	for offset := -1; offset <= 7; offset++ {
+		date := midnight.AddDate(0, 0, offset)
+		for _, w := range s.windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			end := w.end
+			if end <= w.start {
+				end += 24 * 60
+			}
+			edges = append(edges, atMinute(date, w.start), atMinute(date, end))
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Before(edges[j]) })
+
+	current := s.Active(t)
+	for _, edge := range edges {
+		if edge.After(t) && s.Active(edge) != current {
+			return edge
+		}
+	}
+	return time.Time{}
+}
+
+func atMinute(date time.Time, minute int) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), minute/60, minute%60, 0, 0, date.Location())
+}
+
+func (s *Schedule) String() string {
+	parts := make([]string, len(s.windows))
+	for i, w := range s.windows {
+		days := []string{}
+		for d, ok := range w.days {
+			if ok {
+				days = append(days, time.Weekday(d).String()[:3])
+			}
+		}
+		parts[i] = fmt.Sprintf("%s %02d:%02d-%02d:%02d", strings.Join(days, ","), w.start/60, w.start%60, w.end/60, w.end%60)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// MarshalText makes schedules readable in JSON responses like the sync plan.
+func (s *Schedule) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
@@ -0,0 +1,74 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 2023-06-19 is a Monday
+func at(day int, hh, mm int) time.Time {
+	return time.Date(2023, 6, 19+day, hh, mm, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	s, err := Parse("Mon-Fri 17:00-22:00; sat,Sun 09:00-24:00", time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "Mon,Tue,Wed,Thu,Fri 17:00-22:00; Sun,Sat 09:00-24:00", s.String())
+
+	s, err = Parse("Fri-Mon 20:00-02:00", time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "Sun,Mon,Fri,Sat 20:00-02:00", s.String())
+
+	s, err = Parse("Daily 00:00-24:00", time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "Sun,Mon,Tue,Wed,Thu,Fri,Sat 00:00-24:00", s.String())
+
+	for _, invalid := range []string{"", "Mon", "Mon 17:00", "Funday 17:00-18:00", "Mon 17:00-17:00", "Mon 25:00-26:00", "Mon 5pm-6pm"} {
+		_, err := Parse(invalid, time.UTC)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestActive(t *testing.T) {
+	s, err := Parse("Mon-Fri 17:00-22:00; Sat 22:00-02:00", time.UTC)
+	require.NoError(t, err)
+
+	assert.False(t, s.Active(at(0, 16, 59)))
+	assert.True(t, s.Active(at(0, 17, 0)))
+	assert.True(t, s.Active(at(0, 21, 59)))
+	assert.False(t, s.Active(at(0, 22, 0)))
+	assert.False(t, s.Active(at(5, 21, 59)))
+	assert.True(t, s.Active(at(5, 23, 0)))
+	assert.True(t, s.Active(at(6, 1, 59))) // Sunday morning is part of Saturday's window
+	assert.False(t, s.Active(at(6, 2, 0)))
+	assert.False(t, s.Active(at(6, 18, 0)))
+}
+
+func TestActiveTimezone(t *testing.T) {
+	loc := time.FixedZone("CDT", -5*60*60)
+	s, err := Parse("Mon 17:00-22:00", loc)
+	require.NoError(t, err)
+
+	assert.True(t, s.Active(at(0, 22, 0)))   // 17:00 CDT
+	assert.False(t, s.Active(at(0, 17, 30))) // 12:30 CDT
+}
+
+func TestNext(t *testing.T) {
+	s, err := Parse("Mon-Fri 17:00-22:00; Fri 21:00-23:30; Sat 22:00-02:00", time.UTC)
+	require.NoError(t, err)
+
+	assert.Equal(t, at(0, 17, 0), s.Next(at(0, 9, 0)))
+	assert.Equal(t, at(0, 22, 0), s.Next(at(0, 17, 0)))
+	assert.Equal(t, at(1, 17, 0), s.Next(at(0, 22, 0)))
+	assert.Equal(t, at(4, 23, 30), s.Next(at(4, 18, 0))) // overlapping windows
+	assert.Equal(t, at(5, 22, 0), s.Next(at(4, 23, 30)))
+	assert.Equal(t, at(6, 2, 0), s.Next(at(5, 22, 0)))
+	assert.Equal(t, at(7, 17, 0), s.Next(at(6, 2, 0)))
+
+	always, err := Parse("Daily 00:00-24:00", time.UTC)
+	require.NoError(t, err)
+	assert.True(t, always.Next(at(0, 9, 0)).IsZero())
+}
@@ -0,0 +1,398 @@
+// Package simulator implements an in-process stand-in for the access controller's web interface.
+//
+// It speaks the same stateful forms protocol as the real device closely enough to exercise client.Client:
+// a login opens the session, the users page must be visited before deleting, and deletes are a two-step
+// affair keyed on the card slot (ID-1) rather than the ID shown in the table.
+package simulator
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pageSize = 20
+	doors    = 4
+)
+
+type Card struct {
+	ID     int
+	Number int
+	Name   string
+}
+
+type Record struct {
+	ID         int
+	CardNumber int
+	Name       string
+	Status     string
+	Time       time.Time
+}
+
+// Server simulates a single access controller. It implements http.Handler, so it's typically used with httptest.
+type Server struct {
+	// Now is used to timestamp swipe records. Defaults to time.Now.
+	Now func() time.Time
+
+	mut           sync.Mutex
+	loggedIn      bool
+	page          string
+	pendingDelete int // slot of the card awaiting delete confirmation, -1 when none
+	lastCardID    int
+	cards         []*Card // sorted by ID
+	records       []*Record
+}
+
+func New() *Server {
+	return &Server{Now: time.Now, pendingDelete: -1}
+}
+
+// PutCard adds a card directly to the card table, bypassing the web interface.
+func (s *Server) PutCard(number int, name string) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.putCard(number, name)
+}
+
+func (s *Server) putCard(number int, name string) int {
+	s.lastCardID++
+	s.cards = append(s.cards, &Card{ID: s.lastCardID, Number: number, Name: name})
+	return s.lastCardID
+}
+
+// Cards returns a copy of the card table.
+func (s *Server) Cards() []Card {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	cards := make([]Card, len(s.cards))
+	for i, card := range s.cards {
+		cards[i] = *card
+	}
+	return cards
+}
+
+// Swipe records a successful entry for the given card number through the given door (e.g. "#1DOOR").
+func (s *Server) Swipe(number int, door string) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var name string
+	if card := s.findCardByNumber(number); card != nil {
+		name = card.Name
+	}
+	return s.appendRecord(&Record{CardNumber: number, Name: name, Status: fmt.Sprintf("Allow IN[%s]", door)})
+}
+
+// Reboot records a reboot event in the swipe log like the real device does when it loses power.
+func (s *Server) Reboot() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.loggedIn = false
+	return s.appendRecord(&Record{Status: "Reboot"})
+}
+
+// Records returns a copy of the swipe log, oldest first.
+func (s *Server) Records() []Record {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	records := make([]Record, len(s.records))
+	for i, rec := range s.records {
+		records[i] = *rec
+	}
+	return records
+}
+
+// AppendRecord adds an arbitrary row to the swipe log. The ID is assigned automatically, as is the time if unset.
+func (s *Server) AppendRecord(r Record) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.appendRecord(&r)
+}
+
+func (s *Server) appendRecord(r *Record) int {
+	r.ID = len(s.records) + 1
+	if r.Time.IsZero() {
+		r.Time = s.Now()
+	}
+	r.Time = r.Time.Truncate(time.Second)
+	s.records = append(s.records, r)
+	return r.ID
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// The client doesn't always escape form values, so be as forgiving as the real thing
+	form, _ := url.ParseQuery(string(body))
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	// Any request other than the confirmation abandons a pending delete
+	pending := s.pendingDelete
+	s.pendingDelete = -1
+
+	w.Header().Set("Content-Type", "text/html")
+	switch r.URL.Path {
+	case "/ACT_ID_1":
+		s.handleLogin(w, form)
+	case "/ACT_ID_21":
+		s.handleMenu(w, form)
+	case "/ACT_ID_22":
+		s.handleRemoteOpen(w, form)
+	case "/ACT_ID_312":
+		s.handleAddCard(w, form)
+	case "/ACT_ID_324":
+		s.handleDeleteCard(w, form, pending)
+	case "/ACT_ID_325":
+		s.handleListCards(w, form)
+	case "/ACT_ID_345":
+		s.handleListSwipes(w, form)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleLogin(w io.Writer, form url.Values) {
+	if form.Get("username") != "abc" || form.Get("pwd") != "654321" {
+		s.renderLogin(w)
+		return
+	}
+	s.loggedIn = true
+	s.renderHome(w)
+}
+
+func (s *Server) handleMenu(w io.Writer, form url.Values) {
+	switch {
+	case form.Has("s2"):
+		s.renderCards(w, 0)
+	case form.Has("s4"):
+		s.renderSwipes(w, len(s.records))
+	default:
+		s.renderHome(w)
+	}
+}
+
+// handleRemoteOpen mirrors what client.OpenDoor expects, which hasn't been checked against a real device.
+func (s *Server) handleRemoteOpen(w io.Writer, form url.Values) {
+	if !s.loggedIn {
+		s.renderLogin(w)
+		return
+	}
+
+	for key, vals := range form {
+		slot, err := strconv.Atoi(strings.TrimPrefix(key, "D"))
+		if err != nil || slot < 0 || slot >= doors || len(vals) == 0 || vals[0] != "Remote Open" {
+			continue
+		}
+		s.appendRecord(&Record{Status: fmt.Sprintf("Remote Open[#%dDOOR]", slot+1)})
+		s.renderMessage(w, "Open Successfully")
+		return
+	}
+
+	s.renderMessage(w, "Operation failed!")
+}
+
+func (s *Server) handleAddCard(w io.Writer, form url.Values) {
+	if !s.loggedIn {
+		s.renderLogin(w)
+		return
+	}
+	s.page = "add"
+
+	number, err := strconv.Atoi(form.Get("AD21"))
+	if err != nil || number == 0 {
+		s.renderMessage(w, "Card NO is invalid!")
+		return
+	}
+	if s.findCardByNumber(number) != nil {
+		s.renderMessage(w, fmt.Sprintf("Card NO %d already used!", number))
+		return
+	}
+
+	s.putCard(number, form.Get("AD22"))
+	s.renderMessage(w, "Add Successfully")
+}
+
+func (s *Server) handleDeleteCard(w io.Writer, form url.Values, pending int) {
+	if !s.loggedIn {
+		s.renderLogin(w)
+		return
+	}
+
+	for key, vals := range form {
+		if len(key) < 2 || len(vals) == 0 {
+			continue
+		}
+		slot, err := strconv.Atoi(key[1:])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case key[0] == 'D' && vals[0] == "Delete":
+			// The delete buttons only exist on the users page
+			if s.page != "users" || s.findCardByID(slot+1) == nil {
+				s.renderMessage(w, "Operation failed!")
+				return
+			}
+			s.page = "confirm"
+			s.pendingDelete = slot
+			s.renderMessage(w, fmt.Sprintf("[User]->[Delete] User ID %d <input type=submit name=X%d value='OK'>", slot+1, slot))
+			return
+
+		case key[0] == 'X' && vals[0] == "OK":
+			if s.page != "confirm" || pending != slot {
+				s.renderMessage(w, "Operation failed!")
+				return
+			}
+			s.removeCard(slot + 1)
+			s.page = "deleted"
+			s.renderMessage(w, "The user is deleted")
+			return
+		}
+	}
+
+	s.renderMessage(w, "Operation failed!")
+}
+
+func (s *Server) handleListCards(w io.Writer, form url.Values) {
+	if form.Has("PF") {
+		s.renderCards(w, 0)
+		return
+	}
+
+	// PC carries the 1-based position of the first card on the page currently being viewed
+	pos, _ := strconv.Atoi(form.Get("PC"))
+	start := pos - 1
+	if form.Has("PN") {
+		start += pageSize
+	}
+	if start < 0 {
+		start = 0
+	}
+	s.renderCards(w, start)
+}
+
+func (s *Server) handleListSwipes(w io.Writer, form url.Values) {
+	// PC carries the record ID just below the top of the page currently being viewed
+	pc, _ := strconv.Atoi(form.Get("PC"))
+	top := pc + 1
+	if form.Has("PN") {
+		top -= pageSize
+	}
+	if top > len(s.records) {
+		top = len(s.records)
+	}
+	s.renderSwipes(w, top)
+}
+
+func (s *Server) findCardByNumber(number int) *Card {
+	for _, card := range s.cards {
+		if card.Number == number {
+			return card
+		}
+	}
+	return nil
+}
+
+func (s *Server) findCardByID(id int) *Card {
+	i := sort.Search(len(s.cards), func(i int) bool { return s.cards[i].ID >= id })
+	if i < len(s.cards) && s.cards[i].ID == id {
+		return s.cards[i]
+	}
+	return nil
+}
+
+func (s *Server) removeCard(id int) {
+	for i, card := range s.cards {
+		if card.ID == id {
+			s.cards = append(s.cards[:i], s.cards[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) renderLogin(w io.Writer) {
+	s.page = "login"
+	writePage(w, `<form method=post action=ACT_ID_1><p>User Name: <input type=text name=username> Password: <input type=password name=pwd><input type=submit value=Login></p></form>`)
+}
+
+func (s *Server) renderHome(w io.Writer) {
+	s.page = "home"
+	b := &strings.Builder{}
+	b.WriteString("<form method=post action=ACT_ID_21><p><input type=submit name=s2 value=Users><input type=submit name=s4 value=Swipe></p></form>\n")
+	b.WriteString("<form method=post action=ACT_ID_22><table border=1>\n")
+	for slot := 0; slot < doors; slot++ {
+		fmt.Fprintf(b, "<tr><td>#%dDOOR</td><td><input type=submit name=D%d value='Remote Open'></td></tr>\n", slot+1, slot)
+	}
+	b.WriteString("</table></form>")
+	writePage(w, b.String())
+}
+
+func (s *Server) renderMessage(w io.Writer, msg string) {
+	writePage(w, fmt.Sprintf(`<form method=post action=ACT_ID_324><p align=center class=st3>%s</p></form>`, msg))
+}
+
+func (s *Server) renderCards(w io.Writer, start int) {
+	s.page = "users"
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<form method=post action=ACT_ID_325><input type=hidden name=PC value='%05d'><input type=hidden name=PE value='%05d'>", start+1, start+pageSize)
+	fmt.Fprintf(b, "<p><input type=submit name=PF value='First'> <input type=submit name=PN value='Next'> Total Users: %d</p></form>\n", len(s.cards))
+	b.WriteString("<form method=post action=ACT_ID_324><table border=1>\n<tr><th>User ID</th><th>Card NO</th><th>Name</th><th>Operation</th></tr>\n")
+	for i := start; i < start+pageSize && i < len(s.cards); i++ {
+		card := s.cards[i]
+		fmt.Fprintf(b, "<tr><td>%d</td><td>%d</td><td>%s</td><td><input type=submit name=E%d value='Edit'> <input type=submit name=D%d value='Delete'></td></tr>\n",
+			card.ID, card.Number, cellText(card.Name), card.ID-1, card.ID-1)
+	}
+	b.WriteString("</table></form>")
+	writePage(w, b.String())
+}
+
+func (s *Server) renderSwipes(w io.Writer, top int) {
+	s.page = "swipes"
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<form name=swipeRec method=post action=ACT_ID_345><input type=hidden name=PC value='%d'><input type=hidden name=PE value='0'>", top-1)
+	b.WriteString("<p><input type=submit name=PF value='First'> <input type=submit name=PN value='Next'></p></form>\n")
+	b.WriteString("<table border=1>\n<tr><th>Record ID</th><th>Card NO</th><th>Name</th><th>Status</th><th>DateTime</th></tr>\n")
+	for id := top; id > 0 && id > top-pageSize; id-- {
+		rec := s.records[id-1]
+		number := "&nbsp;"
+		if rec.CardNumber != 0 {
+			number = strconv.Itoa(rec.CardNumber)
+		}
+		fmt.Fprintf(b, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			rec.ID, number, cellText(rec.Name), cellText(rec.Status), rec.Time.Format("2006-01-02 15:04:05"))
+	}
+	b.WriteString("</table>")
+	writePage(w, b.String())
+}
+
+// cellText escapes a table cell's contents. The client expects every cell to have a child node, so empty
+// values are rendered as a non-breaking space just like the real device.
+func cellText(val string) string {
+	if val == "" {
+		return "&nbsp;"
+	}
+	return html.EscapeString(val)
+}
+
+func writePage(w io.Writer, body string) {
+	fmt.Fprintf(w, "<html><head><title>Web Controller</title></head><body>\n<h1 align=center class=st1>Web Controller</h1>\n%s\n</body></html>", body)
+}
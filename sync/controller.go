@@ -3,16 +3,22 @@ package sync
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/TheLab-ms/access-controller-controller/auth"
 	"github.com/TheLab-ms/access-controller-controller/client"
 	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/identity"
 	"github.com/TheLab-ms/access-controller-controller/keycloak"
+	"github.com/TheLab-ms/access-controller-controller/notify"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
 )
 
 type accessController interface {
@@ -21,37 +27,149 @@ type accessController interface {
 	ListCards(ctx context.Context) ([]*client.Card, error)
 }
 
-type userStorage interface {
-	ListUsers(ctx context.Context) ([]*keycloak.AccessUser, error)
+type auditLog interface {
+	RecordCardChange(ctx context.Context, change *reporting.CardChange) error
+}
+
+type grantStorage interface {
+	ListGrants(ctx context.Context) ([]*reporting.Grant, error)
+}
+
+type notifier interface {
+	Notify(eventType string, data any)
+}
+
+type webhookStorage interface {
 	CreateWebhook(ctx context.Context, webhook *keycloak.Webhook) error
+	UpdateWebhook(ctx context.Context, webhook *keycloak.Webhook) error
+	DeleteWebhook(ctx context.Context, id string) error
 	ListWebhooks(ctx context.Context) ([]*keycloak.Webhook, error)
+	Rules() *keycloak.Rules
+	Groups() []string
 }
 
 type Controller struct {
 	LastSync atomic.Pointer[time.Time]
 
+	name       string
 	controller accessController
-	storage    userStorage
+	storage    identity.Source
+	webhooks   webhookStorage // only Keycloak supports webhooks
+	audit      auditLog       // optional
+	grants     grantStorage   // optional
+	notifier   notifier       // optional
 	conf       *conf.Env
 	trigger    chan struct{}
+	dryRun     bool // log changes instead of making them
+
+	webhookSecret string // given to Keycloak to sign webhooks with
+	debugToken    string // bearer token required by the debug endpoints
+
+	// Refuse to remove more than this many cards (or percent of all cards) in one sync. Zero disables the limit.
+	maxRemovals, maxRemovalPercent int
+	maxScheduledRemovals           int                                  // removals because schedules or grants ended are routine, so they have their own limit
+	blocked                        atomic.Pointer[Plan]                 // set while a plan is being held back by the removal limit
+	approved                       atomic.Pointer[map[cardKey]struct{}] // the cards an operator approved removing in the next sync
+
+	nextTransition atomic.Pointer[time.Time]           // when the next user's access schedule starts or ends
+	members        atomic.Pointer[map[string]struct{}] // UUIDs of users with access as of the last listing
+	lastFailure    atomic.Pointer[string]              // error from the last sync, nil if it succeeded
+	conflicts      atomic.Pointer[[]*Conflict]         // fobs claimed by more than one user as of the last sync
 }
 
-func NewController(c *conf.Env, cli *client.Client, kc *keycloak.Keycloak) *Controller {
+// NewController creates a sync controller that gives the users from the identity source access to the named access controller.
+// Card changes are recorded, and temporary access grants honored, by the reporting controller when it isn't nil.
+// Card changes and sync failures are sent to outbound webhooks when the notifier isn't nil.
+func NewController(c *conf.Env, name string, cli *client.Client, users identity.Source, rc *reporting.Controller, n *notify.Notifier) *Controller {
 	ctrl := &Controller{
+		name:       name,
 		controller: cli,
-		storage:    kc,
+		storage:    users,
 		conf:       c,
 		trigger:    make(chan struct{}, 1),
+		dryRun:     c.SyncDryRun,
+
+		webhookSecret: c.WebhookSecret,
+		debugToken:    c.DebugToken,
+
+		maxRemovals:          c.SyncMaxRemovals,
+		maxRemovalPercent:    c.SyncMaxRemovalPercent,
+		maxScheduledRemovals: c.SyncMaxScheduledRemovals,
+	}
+	if wh, ok := users.(webhookStorage); ok {
+		ctrl.webhooks = wh
+	}
+	if rc != nil {
+		ctrl.audit = rc
+		ctrl.grants = rc
+	}
+	if n != nil {
+		ctrl.notifier = n
 	}
 	ctrl.trigger <- struct{}{} // sync when starting up
 	return ctrl
 }
 
+// Name returns the name of the access controller managed by this controller.
+func (c *Controller) Name() string { return c.name }
+
+// Health returns an error while the controller is refusing to sync because of the removal limit.
+func (c *Controller) Health() error {
+	if plan := c.blocked.Load(); plan != nil {
+		return fmt.Errorf("controller %s is refusing to remove %d cards until an operator approves", c.name, len(plan.Remove))
+	}
+	return nil
+}
+
+// LastError returns the error from the most recent sync, or nil if it succeeded.
+func (c *Controller) LastError() error {
+	if msg := c.lastFailure.Load(); msg != nil {
+		return errors.New(*msg)
+	}
+	return nil
+}
+
+// Approve allows the currently blocked plan's removals to proceed on the next sync.
+// Returns false if nothing is currently blocked.
+func (c *Controller) Approve() bool {
+	plan := c.blocked.Load()
+	if plan == nil {
+		return false
+	}
+	cards := plan.removedCards()
+	c.approved.Store(&cards)
+	c.Trigger()
+	return true
+}
+
+// Conflicts returns the fobs that were claimed by more than one user during the last sync.
+func (c *Controller) Conflicts() []*Conflict {
+	if conflicts := c.conflicts.Load(); conflicts != nil {
+		return *conflicts
+	}
+	return []*Conflict{}
+}
+
+// Trigger schedules a sync without waiting for the next resync interval.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// ServeHTTP serves the debug endpoints. Keycloak webhooks aren't specific to one access controller, so they're
+// verified and passed to HandleWebhook by the caller instead.
 func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Provide a super secret debug endpoint for listing the current cards
+	// Every endpoint exposes member details or changes sync behavior
+	if !auth.Bearer(w, r, c.debugToken, "debug endpoints") {
+		return
+	}
+
+	// Provide a debug endpoint for listing the current cards
 	if r.URL.Path == "/cards" {
-		log.Printf("received list cards request")
-		cards, err := c.controller.ListCards(r.Context())
+		log.Printf("received list cards request for controller %s", c.name)
+		cards, err := c.listCardStatus(r.Context())
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -60,23 +178,101 @@ func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !strings.HasPrefix(r.URL.Path, "/webhook") {
+	// Show what the next sync would do
+	if r.URL.Path == "/plan" {
+		log.Printf("received plan request for controller %s", c.name)
+		plan, err := c.Plan(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(plan)
 		return
 	}
-	log.Printf("received webhook")
-	select {
-	case c.trigger <- struct{}{}:
+
+	// List the fobs that couldn't be given to everyone who has them
+	if r.URL.Path == "/conflicts" {
+		json.NewEncoder(w).Encode(c.Conflicts())
+		return
+	}
+
+	// Let an operator approve a sync that was held back by the removal limit
+	if r.URL.Path == "/approve" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		if !c.Approve() {
+			http.Error(w, "no sync is waiting for approval", 409)
+			return
+		}
+		log.Printf("operator approved blocked sync for controller %s", c.name)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// HandleWebhook triggers a sync when the body of a verified Keycloak webhook describes a change that could affect building access.
+func (c *Controller) HandleWebhook(body []byte) {
+	event := &keycloak.AdminEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		log.Printf("syncing controller %s because webhook body couldn't be decoded: %s", c.name, err)
+		c.Trigger()
+		return
+	}
+
+	if !c.affectsAccess(event) {
+		log.Printf("ignoring %s webhook for %s on controller %s", event.Type, event.ResourcePath, c.name)
+		return
+	}
+	log.Printf("received %s webhook for %s on controller %s", event.Type, event.ResourcePath, c.name)
+	c.Trigger()
+}
+
+// affectsAccess returns true if the event is about group membership, an authorized group (or subgroup) or any other
+// group the access rules depend on, a user who currently has access, or a user with any of the attributes the rules
+// depend on.
+func (c *Controller) affectsAccess(event *keycloak.AdminEvent) bool {
+	if c.webhooks == nil {
+		return false // webhooks only come from Keycloak
+	}
+	rules := c.webhooks.Rules()
+
+	switch event.ResourceType {
+	case "GROUP_MEMBERSHIP":
+		return true
+	case "GROUP":
+		id := event.GroupID()
+		for _, group := range c.webhooks.Groups() {
+			if id == group {
+				return true
+			}
+		}
+		return false
+	case "USER":
+		if members := c.members.Load(); members != nil {
+			if _, ok := (*members)[event.UserID()]; ok {
+				return true
+			}
+		}
+		return event.HasAttributes(rules.Attributes())
 	default:
+		return false
 	}
 }
 
 func (c *Controller) Run(ctx context.Context) {
 	// Sync periodically
+	ticker := time.NewTicker(c.conf.ResyncInterval)
+	defer ticker.Stop()
 	go func() {
-		for range time.NewTicker(c.conf.ResyncInterval).C {
+		for {
 			select {
-			case c.trigger <- struct{}{}:
-			default:
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.Trigger()
 			}
 		}
 	}()
@@ -87,21 +283,25 @@ func (c *Controller) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-c.trigger:
+		case <-c.transition():
+			c.nextTransition.Store(nil) // fire once, the sync sets the next one
 		}
 
 	start:
-		changed, err := c.sync(ctx)
-		now := time.Now()
-		c.LastSync.Store(&now)
+		_, err := c.SyncOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			log.Printf("sync error: %s", err)
+			log.Printf("sync error on controller %s: %s", c.name, err)
 		} else {
 			lastRetry = 0
-
-			if !changed {
-				time.Sleep(time.Second * 5) // cooldown
-				continue
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * 5): // cooldown
 			}
+			continue
 		}
 
 		if lastRetry == 0 {
@@ -111,86 +311,438 @@ func (c *Controller) Run(ctx context.Context) {
 		if lastRetry > time.Hour {
 			lastRetry = time.Hour
 		}
-		time.Sleep(lastRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lastRetry):
+		case <-c.trigger: // don't make operators wait out the backoff after approving
+		case <-c.transition():
+			c.nextTransition.Store(nil) // fire once, the sync sets the next one
+		}
 		goto start
 	}
 }
 
+// transition fires when the next user's access schedule starts or ends, since they do so at arbitrary times.
+// Returns nil (which blocks forever) when there's no upcoming transition.
+func (c *Controller) transition() <-chan time.Time {
+	next := c.nextTransition.Load()
+	if next == nil {
+		return nil
+	}
+	return time.After(time.Until(*next))
+}
+
+// SyncOnce runs a single sync pass outside of the Run loop, returning true if any cards were changed.
+func (c *Controller) SyncOnce(ctx context.Context) (bool, error) {
+	start := time.Now()
+	changed, err := c.sync(ctx)
+	syncDuration.WithLabelValues(c.name).Observe(time.Since(start).Seconds())
+	if err != nil && ctx.Err() != nil {
+		return changed, err // shutting down, not a failure worth reporting
+	}
+	if err != nil {
+		syncErrors.WithLabelValues(c.name).Inc()
+		msg := err.Error()
+		if last := c.lastFailure.Load(); c.notifier != nil && (last == nil || *last != msg) {
+			c.notifier.Notify(notify.SyncFailed, &notify.SyncFailure{Controller: c.name, Error: msg}) // once per distinct error, not every retry
+		}
+		c.lastFailure.Store(&msg)
+	} else {
+		c.lastFailure.Store(nil)
+	}
+
+	now := time.Now()
+	c.LastSync.Store(&now)
+	return changed, err
+}
+
+// sync applies every change needed to bring the access controller in line with storage in a single pass.
+// Failed changes don't stop the others from being applied. The cards are listed again afterwards to verify
+// that everything took effect, and an error is returned if anything is still outstanding.
 func (c *Controller) sync(ctx context.Context) (bool, error) {
-	goalUsers, err := c.storage.ListUsers(ctx)
+	now := time.Now()
+	goalUsers, err := c.listUsers(ctx)
 	if err != nil {
-		return false, fmt.Errorf("listing users from storage: %w", err)
+		return false, err
+	}
+
+	if next := nextScheduleTransition(goalUsers, now); next.IsZero() {
+		c.nextTransition.Store(nil)
+	} else {
+		c.nextTransition.Store(&next)
 	}
 
 	cards, err := c.controller.ListCards(ctx)
 	if err != nil {
 		return false, fmt.Errorf("listing cards from access controller: %w", err)
 	}
+	cardCount.WithLabelValues(c.name).Set(float64(len(cards)))
 
-	usersByFobID := map[int]*keycloak.AccessUser{}
-	for _, user := range goalUsers {
-		usersByFobID[user.KeyfobNumber] = user
+	plan := newPlan(goalUsers, cards, now)
+	conflicts := plan.Conflicts
+	defer func() { c.reportConflicts(conflicts) }() // including dry runs and refused syncs
+	if plan.Empty() {
+		c.unblock() // e.g. the identity source recovered before anyone approved
+		return false, nil
 	}
 
-	// Clean up unused or incorrectly attributed cards
-	cardsByFobNumber := map[int]*client.Card{}
-	for _, card := range cards {
-		cardsByFobNumber[card.Number] = card
+	if c.dryRun {
+		c.unblock()
+		for _, removal := range plan.Remove {
+			card := removal.Card
+			log.Printf("dry run: would remove card %d (fob %d, name %q) from controller %s because %s", card.ID, card.Number, card.Name, c.name, removal.Reason)
+		}
+		for _, add := range plan.Add {
+			log.Printf("dry run: would associate card %d with user %s on controller %s", add.Number, add.UserUUID, c.name)
+		}
+		return false, nil
+	}
 
-		// Assume that names not managed by this tool are "First Last" and thus will contain a space
-		isManaged := !strings.Contains(card.Name, " ")
+	if err := c.checkRemovalLimit(plan, len(cards)); err != nil {
+		c.blocked.Store(plan)
+		log.Printf("REFUSING TO SYNC CONTROLLER %s: %s - POST /%s/approve to proceed anyway", c.name, err, c.name)
+		return false, err
+	}
+	c.unblock()
 
-		user := usersByFobID[card.Number]
-		if (user == nil && !isManaged) || (user != nil && trimDashes(user.UUID) == card.Name) {
+	var changed bool
+	errs := []string{}
+	audit := []*reporting.CardChange{}
+	for _, removal := range plan.Remove {
+		if ctx.Err() != nil {
+			break // shutting down, the next sync will pick up where this one left off
+		}
+		card := removal.Card
+		err := c.controller.RemoveCard(ctx, card.ID)
+		if err != nil {
+			log.Printf("error removing card %d from controller %s: %s", card.ID, c.name, err)
+			cardChangeErrors.WithLabelValues(c.name, reporting.CardRemoved).Inc()
+			errs = append(errs, fmt.Sprintf("removing card %d from controller: %s", card.ID, err))
 			continue
 		}
 
-		err := c.controller.RemoveCard(ctx, card.ID)
+		log.Printf("removed card %d from controller %s because %s", card.ID, c.name, removal.Reason)
+		cardChanges.WithLabelValues(c.name, reporting.CardRemoved).Inc()
+		changed = true
+		audit = append(audit, &reporting.CardChange{
+			Action:    reporting.CardRemoved,
+			UserUUID:  addDashes(card.Name),
+			FobNumber: card.Number,
+			CardID:    card.ID,
+			Reason:    removal.Reason,
+		})
+	}
+
+	for _, add := range plan.Add {
+		if ctx.Err() != nil {
+			break
+		}
+		err := c.controller.AddCard(ctx, add.Number, add.Name)
+		if errors.Is(err, client.ErrCardIDConflict) {
+			conflicts = append(conflicts, &Conflict{
+				Number: add.Number,
+				Losers: []string{add.UserUUID},
+				Reason: "fob is already in use on the access controller",
+			})
+			audit = append(audit, &reporting.CardChange{
+				Action:    reporting.CardConflict,
+				UserUUID:  add.UserUUID,
+				FobNumber: add.Number,
+				Reason:    "fob is already in use on the access controller",
+			})
+		}
 		if err != nil {
-			return false, fmt.Errorf("removing card %d from controller: %s", card.ID, err)
+			log.Printf("error adding card %d for user %s to controller %s: %s", add.Number, add.UserUUID, c.name, err)
+			cardChangeErrors.WithLabelValues(c.name, reporting.CardAdded).Inc()
+			errs = append(errs, fmt.Sprintf("adding card for user %s: %s", add.UserUUID, err))
+			continue
 		}
 
-		log.Printf("removed card %d from the controller", card.ID)
-		return true, nil
+		log.Printf("associated card %d with user %s on controller %s", add.Number, add.UserUUID, c.name)
+		cardChanges.WithLabelValues(c.name, reporting.CardAdded).Inc()
+		changed = true
+		audit = append(audit, &reporting.CardChange{
+			Action:    reporting.CardAdded,
+			UserUUID:  add.UserUUID,
+			FobNumber: add.Number,
+			Reason:    add.Reason,
+		})
+	}
+	// Record the changes after verification has had a chance to fill in card IDs, even if we're shutting down since they were still made
+	defer c.recordCardChanges(context.Background(), audit)
+	if err := ctx.Err(); err != nil {
+		return changed, err
+	}
+
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("%d of %d changes failed: %s", len(errs), len(plan.Remove)+len(plan.Add), strings.Join(errs, "; "))
 	}
 
-	// Create missing cards
-	for _, user := range goalUsers {
-		_, ok := cardsByFobNumber[user.KeyfobNumber]
-		if ok {
-			continue // already exists
+	cards, err = c.controller.ListCards(ctx)
+	if err != nil {
+		return changed, fmt.Errorf("listing cards from access controller to verify changes: %w", err)
+	}
+	cardCount.WithLabelValues(c.name).Set(float64(len(cards)))
+	if remaining := newPlan(goalUsers, cards, now); !remaining.Empty() {
+		return changed, fmt.Errorf("access controller is still out of sync after applying changes: %d removals and %d additions outstanding", len(remaining.Remove), len(remaining.Add))
+	}
+
+	// Now that we've listed the cards again we know which slots the new cards landed in
+	cardIDsByNumber := map[int]int{}
+	for _, card := range cards {
+		cardIDsByNumber[card.Number] = card.ID
+	}
+	for _, change := range audit {
+		if change.Action == reporting.CardAdded {
+			change.CardID = cardIDsByNumber[change.FobNumber]
 		}
+	}
 
-		err := c.controller.AddCard(ctx, user.KeyfobNumber, trimDashes(user.UUID))
-		if err != nil {
-			return false, fmt.Errorf("adding card for user %s: %s", user.UUID, err)
+	return changed, nil
+}
+
+// reportConflicts logs the conflicts that weren't already reported by the previous sync, and keeps the current set
+// around for the conflicts endpoint and metric.
+func (c *Controller) reportConflicts(conflicts []*Conflict) {
+	key := func(conflict *Conflict) string {
+		return fmt.Sprintf("%d/%s/%s", conflict.Number, conflict.Winner, strings.Join(conflict.Losers, ","))
+	}
+	reported := map[string]struct{}{}
+	if last := c.conflicts.Load(); last != nil {
+		for _, conflict := range *last {
+			reported[key(conflict)] = struct{}{}
 		}
+	}
+
+	for _, conflict := range conflicts {
+		if _, ok := reported[key(conflict)]; ok {
+			continue
+		}
+		losers := strings.Join(conflict.Losers, ", ")
+		if conflict.Winner == "" {
+			log.Printf("fob %d can't be given to user %s on controller %s because %s", conflict.Number, losers, c.name, conflict.Reason)
+			continue
+		}
+		log.Printf("fob %d is claimed by more than one user on controller %s: giving it to user %s (%s) instead of %s", conflict.Number, c.name, conflict.Winner, conflict.Reason, losers)
+	}
+
+	fobConflicts.WithLabelValues(c.name).Set(float64(len(conflicts)))
+	c.conflicts.Store(&conflicts)
+}
+
+func (c *Controller) recordCardChanges(ctx context.Context, changes []*reporting.CardChange) {
+	now := time.Now()
+	for _, change := range changes {
+		change.Controller = c.name
+		change.Time = now
+		if c.audit != nil {
+			if err := c.audit.RecordCardChange(ctx, change); err != nil {
+				log.Printf("error recording %s of card %d in the audit log: %s", change.Action, change.FobNumber, err)
+			}
+		}
+		if c.notifier == nil {
+			continue
+		}
+		switch change.Action {
+		case reporting.CardAdded:
+			c.notifier.Notify(notify.CardAdded, change)
+		case reporting.CardRemoved:
+			c.notifier.Notify(notify.CardRemoved, change)
+		}
+	}
+}
+
+type cardStatus struct {
+	*client.Card
+	ExpiresAt *time.Time `json:",omitempty"`
+	Expired   bool       `json:",omitempty"`
+}
+
+// listCardStatus lists the cards on the access controller along with their expiration, if any.
+// Expired cards are included too, even though they've been removed from the access controller.
+func (c *Controller) listCardStatus(ctx context.Context) ([]*cardStatus, error) {
+	cards, err := c.controller.ListCards(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := c.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiringUsers := map[string]*identity.AccessUser{}
+	for _, user := range users {
+		if !user.ExpiresAt.IsZero() {
+			expiringUsers[trimDashes(user.UUID)] = user
+		}
+	}
+
+	all := []*cardStatus{}
+	onController := map[int]struct{}{}
+	for _, card := range cards {
+		status := &cardStatus{Card: card}
+		if user := expiringUsers[card.Name]; user != nil {
+			status.ExpiresAt = &user.ExpiresAt
+			status.Expired = !now.Before(user.ExpiresAt)
+			onController[card.Number] = struct{}{}
+		}
+		all = append(all, status)
+	}
+	for name, user := range expiringUsers {
+		if now.Before(user.ExpiresAt) {
+			continue // not on the controller yet
+		}
+		for _, fob := range user.KeyfobNumbers {
+			if _, ok := onController[fob]; !ok {
+				all = append(all, &cardStatus{Card: &client.Card{Number: fob, Name: name}, ExpiresAt: &user.ExpiresAt, Expired: true})
+			}
+		}
+	}
 
-		log.Printf("associated card %d with user %s", user.KeyfobNumber, user.UUID)
-		return true, nil
+	return all, nil
+}
+
+// listUsers returns the users from storage along with any temporary access grants.
+func (c *Controller) listUsers(ctx context.Context) ([]*identity.AccessUser, error) {
+	users, err := c.storage.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing users from storage: %w", err)
+	}
+
+	members := map[string]struct{}{}
+	for _, user := range users {
+		members[user.UUID] = struct{}{}
+	}
+	c.members.Store(&members)
+
+	if c.grants == nil {
+		return users, nil
+	}
+
+	grants, err := c.grants.ListGrants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing access grants: %w", err)
+	}
+	for _, grant := range grants {
+		users = append(users, grant.AccessUser())
+	}
+	return users, nil
+}
+
+// unblock forgets the blocked plan and any approval for it, since the latest plan didn't need one.
+func (c *Controller) unblock() {
+	c.blocked.Store(nil)
+	c.approved.Store(nil)
+}
+
+// checkRemovalLimit returns an error if the plan would remove more cards than allowed, unless an operator has approved it.
+func (c *Controller) checkRemovalLimit(plan *Plan, totalCards int) error {
+	n := plan.unscheduledRemovals()
+	if approved := c.approved.Swap(nil); approved != nil && plan.removesOnly(*approved) {
+		return nil // an approval only applies to the next plan, and only to the cards that were approved
 	}
 
-	return false, nil
+	if c.maxRemovals > 0 && n > c.maxRemovals {
+		return fmt.Errorf("plan removes %d cards, which exceeds the limit of %d", n, c.maxRemovals)
+	}
+	if c.maxRemovalPercent > 0 && totalCards > 0 && n*100 > c.maxRemovalPercent*totalCards {
+		return fmt.Errorf("plan removes %d of %d cards, which exceeds the limit of %d%%", n, totalCards, c.maxRemovalPercent)
+	}
+	// e.g. an invalid schedule attribute shared by everyone
+	if scheduled := len(plan.Remove) - n; c.maxScheduledRemovals > 0 && scheduled > c.maxScheduledRemovals {
+		return fmt.Errorf("plan removes %d cards whose access schedules or grants ended, which exceeds the limit of %d", scheduled, c.maxScheduledRemovals)
+	}
+	return nil
 }
 
+// webhookEventTypes are the keycloak-events types the webhook subscribes to. HandleWebhook filters them further.
+var webhookEventTypes = []string{"admin.*"}
+
+// EnsureWebhook registers the webhook with Keycloak, or updates it to match the current configuration.
+// Webhooks are tagged with an owner in their URL so ones left behind by a previous CallbackURL can be deleted.
 func (c *Controller) EnsureWebhook(ctx context.Context) error {
-	hooks, err := c.storage.ListWebhooks(ctx)
+	if c.webhooks == nil {
+		return errors.New("the identity source doesn't support webhooks")
+	}
+	hooks, err := c.webhooks.ListWebhooks(ctx)
 	if err != nil {
 		return fmt.Errorf("listing: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/webhook", c.conf.CallbackURL)
+	desired := &keycloak.Webhook{
+		Enabled:    true,
+		URL:        c.webhookURL(),
+		Secret:     c.webhookSecret,
+		EventTypes: webhookEventTypes,
+	}
 	for _, hook := range hooks {
-		if hook.URL == url {
-			return nil // already exists
+		if !c.ownsWebhook(hook) {
+			continue
+		}
+
+		// Update the first matching webhook since there's no way to tell which secret it was registered with
+		if hook.URL == desired.URL && desired.ID == "" {
+			desired.ID = hook.ID
+			if err := c.webhooks.UpdateWebhook(ctx, desired); err != nil {
+				return fmt.Errorf("updating %s: %w", hook.ID, err)
+			}
+			continue
+		}
+
+		log.Printf("deleting stale webhook %s with URL %s", hook.ID, hook.URL)
+		if err := c.webhooks.DeleteWebhook(ctx, hook.ID); err != nil {
+			return fmt.Errorf("deleting %s: %w", hook.ID, err)
 		}
 	}
+	if desired.ID != "" {
+		return nil
+	}
 
-	return c.storage.CreateWebhook(ctx, &keycloak.Webhook{
-		Enabled:    true,
-		URL:        url,
-		EventTypes: []string{"admin.*"},
-	})
+	log.Printf("registering webhook with URL %s", desired.URL)
+	return c.webhooks.CreateWebhook(ctx, desired)
+}
+
+// RemoveWebhook deletes every webhook registered by EnsureWebhook.
+func (c *Controller) RemoveWebhook(ctx context.Context) error {
+	if c.webhooks == nil {
+		return nil
+	}
+	hooks, err := c.webhooks.ListWebhooks(ctx)
+	if err != nil {
+		return fmt.Errorf("listing: %w", err)
+	}
+	for _, hook := range hooks {
+		if !c.ownsWebhook(hook) {
+			continue
+		}
+		if err := c.webhooks.DeleteWebhook(ctx, hook.ID); err != nil {
+			return fmt.Errorf("deleting %s: %w", hook.ID, err)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) webhookURL() string {
+	return fmt.Sprintf("%s/webhook?owner=%s", c.conf.CallbackURL, url.QueryEscape(c.conf.WebhookOwner))
+}
+
+// ownsWebhook returns true for webhooks tagged with our owner, and the untagged webhook registered by older versions.
+func (c *Controller) ownsWebhook(hook *keycloak.Webhook) bool {
+	if hook.URL == c.conf.CallbackURL+"/webhook" {
+		return true
+	}
+	u, err := url.Parse(hook.URL)
+	return err == nil && u.Query().Get("owner") == c.conf.WebhookOwner
+}
+
+// addDashes reverses trimDashes, returning an empty string if the card name isn't a uuid (i.e. not managed by us).
+func addDashes(name string) string {
+	if len(name) != 32 || strings.Contains(name, " ") {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", name[:8], name[8:12], name[12:16], name[16:20], name[20:])
 }
 
 // trimDashes removes dashes from a uuid, which is necessary because the controller doesn't allow dashes in card names.
@@ -2,13 +2,29 @@ package sync
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/conf"
+	"github.com/TheLab-ms/access-controller-controller/identity"
 	"github.com/TheLab-ms/access-controller-controller/keycloak"
+	"github.com/TheLab-ms/access-controller-controller/notify"
+	"github.com/TheLab-ms/access-controller-controller/reporting"
+	"github.com/TheLab-ms/access-controller-controller/simulator"
 )
 
 func TestControllerBasics(t *testing.T) {
@@ -24,9 +40,9 @@ func TestControllerBasics(t *testing.T) {
 	})
 
 	t.Run("initial creation", func(t *testing.T) {
-		tus.users = []*keycloak.AccessUser{{
-			UUID:         "592af547-8f68-42d8-8b81-4a5d233b7cce",
-			KeyfobNumber: 9001,
+		tus.users = []*identity.AccessUser{{
+			UUID:          "592af547-8f68-42d8-8b81-4a5d233b7cce",
+			KeyfobNumbers: []int{9001},
 		}}
 
 		changed, err := c.sync(context.Background())
@@ -49,21 +65,15 @@ func TestControllerBasics(t *testing.T) {
 	})
 
 	t.Run("update fob ID for existing user", func(t *testing.T) {
-		tus.users = []*keycloak.AccessUser{{
-			UUID:         "592af547-8f68-42d8-8b81-4a5d233b7cce",
-			KeyfobNumber: 9002,
+		tus.users = []*identity.AccessUser{{
+			UUID:          "592af547-8f68-42d8-8b81-4a5d233b7cce",
+			KeyfobNumbers: []int{9002},
 		}}
 
-		// remove
+		// remove and recreate
 		changed, err := c.sync(context.Background())
 		require.NoError(t, err)
 		assert.True(t, changed)
-		assert.Equal(t, tac.cards, map[int]*client.Card{})
-
-		// recreate
-		changed, err = c.sync(context.Background())
-		require.NoError(t, err)
-		assert.True(t, changed)
 
 		// done
 		changed, err = c.sync(context.Background())
@@ -81,21 +91,15 @@ func TestControllerBasics(t *testing.T) {
 	})
 
 	t.Run("update UUID ID for existing fob", func(t *testing.T) {
-		tus.users = []*keycloak.AccessUser{{
-			UUID:         "592af547-8f68-42d8-8b81-4a5d233b7cc2",
-			KeyfobNumber: 9002,
+		tus.users = []*identity.AccessUser{{
+			UUID:          "592af547-8f68-42d8-8b81-4a5d233b7cc2",
+			KeyfobNumbers: []int{9002},
 		}}
 
-		// remove
+		// remove and recreate
 		changed, err := c.sync(context.Background())
 		require.NoError(t, err)
 		assert.True(t, changed)
-		assert.Equal(t, tac.cards, map[int]*client.Card{})
-
-		// recreate
-		changed, err = c.sync(context.Background())
-		require.NoError(t, err)
-		assert.True(t, changed)
 
 		// done
 		changed, err = c.sync(context.Background())
@@ -149,15 +153,15 @@ func TestControllerBasics(t *testing.T) {
 		})
 	})
 
-	t.Run("duplicate badge IDs are ignored", func(t *testing.T) {
-		tus.users = []*keycloak.AccessUser{
+	t.Run("duplicate badge IDs stay with the current card holder", func(t *testing.T) {
+		tus.users = []*identity.AccessUser{
 			{
-				UUID:         "592af547-8f68-42d8-8b81-4a5d233b7cc3",
-				KeyfobNumber: 9002,
+				UUID:          "592af547-8f68-42d8-8b81-4a5d233b7cc3",
+				KeyfobNumbers: []int{9002},
 			},
 			{
-				UUID:         "592af547-8f68-42d8-8b81-4a5d233b7cc2",
-				KeyfobNumber: 9002,
+				UUID:          "592af547-8f68-42d8-8b81-4a5d233b7cc2",
+				KeyfobNumbers: []int{9002},
 			},
 		}
 
@@ -172,15 +176,603 @@ func TestControllerBasics(t *testing.T) {
 				Name:   "592af5478f6842d88b814a5d233b7cc2",
 			},
 		})
+		assert.Equal(t, []*Conflict{{
+			Number: 9002,
+			Winner: "592af547-8f68-42d8-8b81-4a5d233b7cc2",
+			Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b7cc3"},
+			Reason: "user already has a card for this fob",
+		}}, c.Conflicts())
+	})
+
+	t.Run("resolved conflicts are cleared", func(t *testing.T) {
+		tus.users = tus.users[1:]
+
+		_, err := c.sync(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, c.Conflicts())
+	})
+}
+
+func TestControllerAgainstSimulator(t *testing.T) {
+	sim := simulator.New()
+	svr := httptest.NewServer(sim)
+	t.Cleanup(svr.Close)
+
+	sim.PutCard(500, "Unmanaged User") // not managed by us
+	sim.PutCard(501, "stale")          // managed but no longer in keycloak
+
+	tus := &testUserStorage{}
+	for i := 0; i < 25; i++ {
+		tus.users = append(tus.users, &identity.AccessUser{
+			UUID:          fmt.Sprintf("592af547-8f68-42d8-8b81-4a5d233b%04d", i),
+			KeyfobNumbers: []int{9000 + i},
+		})
+	}
+
+	cli := &client.Client{Addr: strings.TrimPrefix(svr.URL, "http://"), Timeout: time.Second}
+	c := &Controller{controller: cli, storage: tus}
+
+	converge := func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			changed, err := c.sync(context.Background())
+			require.NoError(t, err)
+			if !changed {
+				return
+			}
+		}
+		t.Fatal("sync did not converge")
+	}
+
+	t.Run("initial sync", func(t *testing.T) {
+		converge(t)
+
+		cards := sim.Cards()
+		require.Len(t, cards, 26)
+		assert.Equal(t, simulator.Card{ID: 1, Number: 500, Name: "Unmanaged User"}, cards[0])
+		for i, card := range cards[1:] {
+			assert.Equal(t, 9000+i, card.Number)
+			assert.Equal(t, fmt.Sprintf("592af5478f6842d88b814a5d233b%04d", i), card.Name)
+		}
+	})
+
+	t.Run("remove users", func(t *testing.T) {
+		tus.users = tus.users[5:]
+		converge(t)
+
+		cards := sim.Cards()
+		require.Len(t, cards, 21)
+		for _, card := range cards[1:] {
+			assert.GreaterOrEqual(t, card.Number, 9005)
+		}
+	})
+}
+
+func TestControllerPartialFailure(t *testing.T) {
+	tac := &testAccessController{
+		cards: map[int]*client.Card{
+			0: {ID: 0, Number: 100, Name: "592af5478f6842d88b814a5d233b0000"},
+		},
+		lastID:  1,
+		failAdd: map[int]error{200: errors.New("oops")},
+	}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{200}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{300}},
+	}}
+	c := &Controller{controller: tac, storage: tus}
+
+	changed, err := c.sync(context.Background())
+	assert.True(t, changed)
+	assert.EqualError(t, err, "1 of 3 changes failed: adding card for user 592af547-8f68-42d8-8b81-4a5d233b0001: oops")
+
+	// the other changes were still applied
+	assert.Equal(t, map[int]*client.Card{
+		1: {ID: 1, Number: 300, Name: "592af5478f6842d88b814a5d233b0002"},
+	}, tac.cards)
+
+	delete(tac.failAdd, 200)
+	changed, err = c.sync(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, tac.cards, 2)
+}
+
+func TestControllerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tac := &testAccessController{
+		cards: map[int]*client.Card{
+			0: {ID: 0, Number: 100, Name: "592af5478f6842d88b814a5d233b0000"},
+			1: {ID: 1, Number: 200, Name: "592af5478f6842d88b814a5d233b0001"},
+		},
+		lastID:   2,
+		onRemove: cancel, // the signal arrives while the first removal is in flight
+	}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{300}},
+	}}
+	tal := &testAuditLog{}
+	c := &Controller{name: "front", controller: tac, storage: tus, audit: tal, trigger: make(chan struct{}, 1), conf: &conf.Env{ResyncInterval: time.Hour}}
+
+	changed, err := c.SyncOnce(ctx)
+	assert.True(t, changed)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, c.LastError()) // not reported as a failure
+
+	// the removal that was in flight finished and was recorded, but nothing else was changed
+	assert.Len(t, tac.cards, 1)
+	require.Len(t, tal.changes, 1)
+	assert.Equal(t, reporting.CardRemoved, tal.changes[0].Action)
+
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after the context was canceled")
+	}
+}
+
+func TestControllerRetryAtTransition(t *testing.T) {
+	tus := &testUserStorage{err: errors.New("identity source is down")}
+	c := &Controller{name: "front", controller: &testAccessController{cards: map[int]*client.Card{}}, storage: tus, trigger: make(chan struct{}, 1), conf: &conf.Env{ResyncInterval: time.Hour}}
+	c.Trigger()
+	next := time.Now().Add(time.Millisecond * 50)
+	c.nextTransition.Store(&next)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.Run(ctx)
+
+	// The first retry is 375ms after the failure, but the schedule transition comes first
+	assert.Eventually(t, func() bool { return tus.listed.Load() >= 2 }, time.Millisecond*250, time.Millisecond*10)
+}
+
+func TestControllerMetrics(t *testing.T) {
+	tac := &testAccessController{
+		cards: map[int]*client.Card{
+			0: {ID: 0, Number: 100, Name: "592af5478f6842d88b814a5d233b0000"},
+		},
+		lastID:  1,
+		failAdd: map[int]error{200: errors.New("oops")},
+	}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{200}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{300}},
+	}}
+	c := &Controller{name: "metrics", controller: tac, storage: tus}
+	for _, vec := range []interface{ Reset() }{cardChanges, cardChangeErrors, syncErrors} {
+		vec.Reset() // the metrics are global, so start from zero when the test is repeated
+	}
+
+	_, err := c.SyncOnce(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(cardChanges.WithLabelValues("metrics", reporting.CardRemoved)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cardChanges.WithLabelValues("metrics", reporting.CardAdded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cardChangeErrors.WithLabelValues("metrics", reporting.CardAdded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(syncErrors.WithLabelValues("metrics")))
+
+	delete(tac.failAdd, 200)
+	_, err = c.SyncOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(cardChanges.WithLabelValues("metrics", reporting.CardAdded)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(cardCount.WithLabelValues("metrics")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(syncErrors.WithLabelValues("metrics")))
+	assert.NotNil(t, c.LastSync.Load())
+}
+
+func TestControllerAuditLog(t *testing.T) {
+	tac := &testAccessController{
+		cards: map[int]*client.Card{
+			0: {ID: 0, Number: 100, Name: "592af5478f6842d88b814a5d233b0000"},
+			1: {ID: 1, Number: 300, Name: "Some Person"},
+		},
+		lastID:  2,
+		failAdd: map[int]error{300: client.ErrCardIDConflict},
+	}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{200}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{300}},
+	}}
+	tal := &testAuditLog{}
+	c := &Controller{name: "front", controller: tac, storage: tus, audit: tal}
+
+	_, err := c.sync(context.Background())
+	require.Error(t, err)
+
+	for _, change := range tal.changes {
+		assert.Equal(t, "front", change.Controller)
+		assert.False(t, change.Time.IsZero())
+		change.Time = time.Time{}
+	}
+	assert.Equal(t, []*reporting.CardChange{
+		{Controller: "front", Action: reporting.CardRemoved, UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0000", FobNumber: 100, CardID: 0, Reason: "no authorized user has this fob"},
+		{Controller: "front", Action: reporting.CardRemoved, FobNumber: 300, CardID: 1, Reason: "fob is assigned to user 592af547-8f68-42d8-8b81-4a5d233b0002"},
+		{Controller: "front", Action: reporting.CardAdded, UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0001", FobNumber: 200, Reason: "authorized user has no card"},
+		{Controller: "front", Action: reporting.CardConflict, UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0002", FobNumber: 300, Reason: "fob is already in use on the access controller"},
+	}, sortedChanges(tal.changes))
+	assert.Equal(t, []*Conflict{
+		{Number: 300, Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0002"}, Reason: "fob is already in use on the access controller"},
+	}, c.Conflicts())
+
+	t.Run("card IDs of additions are filled in", func(t *testing.T) {
+		tal.changes = nil
+		delete(tac.failAdd, 300)
+
+		_, err := c.sync(context.Background())
+		require.NoError(t, err)
+		require.Len(t, tal.changes, 1)
+		assert.Equal(t, 3, tal.changes[0].CardID)
+	})
+}
+
+func TestControllerNotifications(t *testing.T) {
+	tac := &testAccessController{
+		cards: map[int]*client.Card{
+			0: {ID: 0, Number: 100, Name: "592af5478f6842d88b814a5d233b0000"},
+		},
+		lastID:  1,
+		failAdd: map[int]error{200: errors.New("oops")},
+	}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{200}},
+	}}
+	tn := &testNotifier{}
+	c := &Controller{name: "front", controller: tac, storage: tus, notifier: tn}
+
+	_, err := c.SyncOnce(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, []string{notify.CardRemoved, notify.SyncFailed}, tn.types)
+	assert.Equal(t, 0, tn.data[0].(*reporting.CardChange).CardID)
+	assert.Equal(t, &notify.SyncFailure{Controller: "front", Error: "1 of 2 changes failed: adding card for user 592af547-8f68-42d8-8b81-4a5d233b0001: oops"}, tn.data[1])
+
+	t.Run("repeated failures are only sent once", func(t *testing.T) {
+		tn.types, tn.data = nil, nil
+		for i := 0; i < 2; i++ {
+			_, err := c.SyncOnce(context.Background())
+			require.Error(t, err)
+		}
+		assert.Equal(t, []string{notify.SyncFailed}, tn.types)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		tn.types, tn.data = nil, nil
+		delete(tac.failAdd, 200)
+		_, err := c.SyncOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{notify.CardAdded}, tn.types)
+		assert.Equal(t, 1, tn.data[0].(*reporting.CardChange).CardID)
+	})
+}
+
+func TestControllerHTTPAuth(t *testing.T) {
+	tac := &testAccessController{cards: map[int]*client.Card{}}
+	tus := &testUserStorage{}
+	c := &Controller{name: "front", controller: tac, storage: tus, webhooks: tus, trigger: make(chan struct{}, 1), debugToken: "token"}
+
+	serve := func(method, path, body string, header map[string]string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("debug endpoints", func(t *testing.T) {
+		assert.Equal(t, 401, serve("GET", "/cards", "", nil))
+		assert.Equal(t, 401, serve("GET", "/plan", "", map[string]string{"Authorization": "Bearer wrong"}))
+		assert.Equal(t, 200, serve("GET", "/cards", "", map[string]string{"Authorization": "Bearer token"}))
+		assert.Equal(t, 401, serve("GET", "/conflicts", "", nil))
+		assert.Equal(t, 200, serve("GET", "/conflicts", "", map[string]string{"Authorization": "Bearer token"}))
+	})
+
+	t.Run("webhooks aren't served per controller", func(t *testing.T) {
+		body := `{"resourceType": "GROUP_MEMBERSHIP"}`
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(body))
+		assert.Equal(t, 401, serve("POST", "/webhook", body, map[string]string{keycloak.SignatureHeader: hex.EncodeToString(mac.Sum(nil))}))
+		assert.Len(t, c.trigger, 0)
+	})
+}
+
+func TestControllerWebhookFilter(t *testing.T) {
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100}},
+	}}
+	tus.rules = &keycloak.Rules{KeyfobAttribute: "badgeNumber"}
+	tus.groups = []string{"authorized-group", "authorized-subgroup", "suspended-group"}
+	c := &Controller{name: "front", storage: tus, webhooks: tus, trigger: make(chan struct{}, 1)}
+	_, err := c.listUsers(context.Background())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		expected bool
+	}{
+		{"group membership", `{"resourceType": "GROUP_MEMBERSHIP", "resourcePath": "users/someone/groups/authorized-group"}`, true},
+		{"authorized group deleted", `{"resourceType": "GROUP", "resourcePath": "groups/authorized-group"}`, true},
+		{"subgroup deleted", `{"resourceType": "GROUP", "resourcePath": "groups/authorized-subgroup"}`, true},
+		{"subgroup created", `{"resourceType": "GROUP", "resourcePath": "groups/authorized-group/children"}`, true},
+		{"excluded group deleted", `{"resourceType": "GROUP", "resourcePath": "groups/suspended-group"}`, true},
+		{"other group", `{"resourceType": "GROUP", "resourcePath": "groups/another-group"}`, false},
+		{"member updated", `{"resourceType": "USER", "resourcePath": "users/592af547-8f68-42d8-8b81-4a5d233b0001", "representation": "{}"}`, true},
+		{"fob added to non-member", `{"resourceType": "USER", "resourcePath": "users/someone", "representation": "{\"attributes\": {\"badgeNumber\": [\"123\"]}}"}`, true},
+		{"unmapped attribute", `{"resourceType": "USER", "resourcePath": "users/someone", "representation": "{\"attributes\": {\"keyfobID\": [\"123\"]}}"}`, false},
+		{"non-member updated", `{"resourceType": "USER", "resourcePath": "users/someone", "representation": "{\"attributes\": {\"shoeSize\": [\"12\"]}}"}`, false},
+		{"client updated", `{"resourceType": "CLIENT", "resourcePath": "clients/some-client"}`, false},
+		{"undecodable", `not json`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c.HandleWebhook([]byte(tc.body))
+			assert.Equal(t, tc.expected, len(c.trigger) == 1)
+			for len(c.trigger) > 0 {
+				<-c.trigger
+			}
+		})
+	}
+}
+
+func TestControllerEnsureWebhook(t *testing.T) {
+	tus := &testUserStorage{webhooks: []*keycloak.Webhook{
+		{ID: "someone-else", URL: "https://example.com/hook", EventTypes: []string{"*"}},
+		{ID: "legacy", URL: "https://acc.example.com/webhook", EventTypes: []string{"admin.*"}},
+		{ID: "old-url", URL: "https://old.example.com/webhook?owner=acc", EventTypes: []string{"admin.*"}},
+		{ID: "other-owner", URL: "https://old.example.com/webhook?owner=staging", EventTypes: []string{"admin.*"}},
+	}}
+	env := &conf.Env{CallbackURL: "https://acc.example.com", WebhookOwner: "acc"}
+	c := &Controller{storage: tus, webhooks: tus, conf: env, webhookSecret: "secret"}
+
+	t.Run("create and clean up", func(t *testing.T) {
+		require.NoError(t, c.EnsureWebhook(context.Background()))
+
+		ids := []string{}
+		for _, hook := range tus.webhooks {
+			ids = append(ids, hook.ID)
+		}
+		assert.Equal(t, []string{"someone-else", "other-owner", "hook-102"}, ids)
+		assert.Equal(t, &keycloak.Webhook{
+			ID:         "hook-102",
+			Enabled:    true,
+			URL:        "https://acc.example.com/webhook?owner=acc",
+			Secret:     "secret",
+			EventTypes: webhookEventTypes,
+		}, tus.webhooks[2])
+	})
+
+	t.Run("update", func(t *testing.T) {
+		tus.webhooks[2].EventTypes = []string{"admin.USER-UPDATE"}
+		tus.webhooks[2].Enabled = false
+		c.webhookSecret = "new secret"
+
+		require.NoError(t, c.EnsureWebhook(context.Background()))
+		require.Len(t, tus.webhooks, 3)
+		assert.Equal(t, webhookEventTypes, tus.webhooks[2].EventTypes)
+		assert.True(t, tus.webhooks[2].Enabled)
+		assert.Equal(t, "new secret", tus.webhooks[2].Secret)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, c.RemoveWebhook(context.Background()))
+		require.Len(t, tus.webhooks, 2)
+	})
+}
+
+func TestControllerEnsureWebhookNewHost(t *testing.T) {
+	tus := &testUserStorage{webhooks: []*keycloak.Webhook{
+		{ID: "old-host", URL: "https://old.example.com/webhook?owner=access-controller-controller"},
+		{ID: "staging", URL: "https://staging.example.com/webhook?owner=staging"},
+	}}
+	env := &conf.Env{CallbackURL: "https://acc.example.com", WebhookOwner: "access-controller-controller"}
+	c := &Controller{storage: tus, webhooks: tus, conf: env, webhookSecret: "secret"}
+
+	// The owner doesn't depend on the callback URL, so the webhook left behind at the old host is still ours
+	require.NoError(t, c.EnsureWebhook(context.Background()))
+	require.Len(t, tus.webhooks, 2)
+	assert.Equal(t, "staging", tus.webhooks[0].ID)
+	assert.Equal(t, "https://acc.example.com/webhook?owner=access-controller-controller", tus.webhooks[1].URL)
+}
+
+// sortedChanges puts removals first since the order cards are listed (and therefore removed) in isn't stable.
+func sortedChanges(changes []*reporting.CardChange) []*reporting.CardChange {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Action == reporting.CardRemoved && changes[j].Action == reporting.CardRemoved {
+			return changes[i].CardID < changes[j].CardID
+		}
+		return changes[i].Action == reporting.CardRemoved && changes[j].Action != reporting.CardRemoved
+	})
+	return changes
+}
+
+func TestControllerRemovalLimit(t *testing.T) {
+	tac := &testAccessController{cards: map[int]*client.Card{}}
+	tus := &testUserStorage{}
+	for i := 0; i < 10; i++ {
+		tus.users = append(tus.users, &identity.AccessUser{
+			UUID:          fmt.Sprintf("592af547-8f68-42d8-8b81-4a5d233b%04d", i),
+			KeyfobNumbers: []int{100 + i},
+		})
+	}
+	c := &Controller{controller: tac, storage: tus, trigger: make(chan struct{}, 1), maxRemovals: 3}
+
+	_, err := c.sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tac.cards, 10)
+
+	t.Run("within the limit", func(t *testing.T) {
+		tus.users = tus.users[3:]
+		changed, err := c.sync(context.Background())
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Len(t, tac.cards, 7)
+		assert.NoError(t, c.Health())
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		assert.False(t, c.Approve())
+
+		tus.users = nil
+		changed, err := c.sync(context.Background())
+		assert.EqualError(t, err, "plan removes 7 cards, which exceeds the limit of 3")
+		assert.False(t, changed)
+		assert.Len(t, tac.cards, 7)
+		assert.Error(t, c.Health())
+	})
+
+	t.Run("approved", func(t *testing.T) {
+		assert.True(t, c.Approve())
+
+		changed, err := c.sync(context.Background())
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Len(t, tac.cards, 0)
+		assert.NoError(t, c.Health())
+	})
+
+	t.Run("percent", func(t *testing.T) {
+		c.maxRemovals = 0
+		c.maxRemovalPercent = 50
+		for i := 0; i < 4; i++ {
+			tac.AddCard(context.Background(), 200+i, fmt.Sprintf("stale%d", i))
+		}
+
+		tus.users = []*identity.AccessUser{}
+		_, err := c.sync(context.Background())
+		assert.EqualError(t, err, "plan removes 4 of 4 cards, which exceeds the limit of 50%")
+	})
+}
+
+func TestControllerRemovalApproval(t *testing.T) {
+	tac := &testAccessController{cards: map[int]*client.Card{}}
+	tus := &testUserStorage{}
+	for i := 0; i < 5; i++ {
+		tus.users = append(tus.users, &identity.AccessUser{
+			UUID:          fmt.Sprintf("592af547-8f68-42d8-8b81-4a5d233b%04d", i),
+			KeyfobNumbers: []int{100 + i},
+		})
+	}
+	members := tus.users
+	c := &Controller{controller: tac, storage: tus, trigger: make(chan struct{}, 1), maxRemovals: 3}
+
+	_, err := c.sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tac.cards, 5)
+
+	t.Run("recovering clears the block and approval", func(t *testing.T) {
+		tus.users = nil
+		_, err := c.sync(context.Background())
+		assert.Error(t, err)
+		assert.Error(t, c.Health())
+		assert.True(t, c.Approve())
+
+		tus.users = members
+		_, err = c.sync(context.Background())
+		require.NoError(t, err)
+		assert.NoError(t, c.Health())
+		assert.Nil(t, c.approved.Load())
+
+		// The earlier approval doesn't let a later mass removal through
+		tus.users = nil
+		_, err = c.sync(context.Background())
+		assert.Error(t, err)
+		assert.Len(t, tac.cards, 5)
+	})
+
+	t.Run("approval only covers the approved cards", func(t *testing.T) {
+		assert.True(t, c.Approve())
+		tac.AddCard(context.Background(), 200, "stale")
+
+		_, err := c.sync(context.Background())
+		assert.EqualError(t, err, "plan removes 6 cards, which exceeds the limit of 3")
+		assert.Len(t, tac.cards, 6)
+
+		// Approvals are for the fobs, not the slots they're in
+		assert.True(t, c.Approve())
+		tac.cards[tac.lastID] = tac.cards[0]
+		tac.cards[tac.lastID].ID = tac.lastID
+		delete(tac.cards, 0)
+		tac.lastID++
+
+		_, err = c.sync(context.Background())
+		require.NoError(t, err)
+		assert.Len(t, tac.cards, 0)
+		assert.NoError(t, c.Health())
 	})
 }
 
+func TestControllerScheduledRemovalLimit(t *testing.T) {
+	tac := &testAccessController{cards: map[int]*client.Card{}}
+	tus := &testUserStorage{}
+	for i := 0; i < 5; i++ {
+		tus.users = append(tus.users, &identity.AccessUser{
+			UUID:          fmt.Sprintf("592af547-8f68-42d8-8b81-4a5d233b%04d", i),
+			KeyfobNumbers: []int{100 + i},
+		})
+	}
+	c := &Controller{controller: tac, storage: tus, trigger: make(chan struct{}, 1), maxRemovals: 3, maxScheduledRemovals: 3}
+
+	_, err := c.sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tac.cards, 5)
+
+	// e.g. everyone was given the same bad expiration
+	for _, user := range tus.users {
+		user.ExpiresAt = time.Now().Add(-time.Minute)
+	}
+	_, err = c.sync(context.Background())
+	assert.EqualError(t, err, "plan removes 5 cards whose access schedules or grants ended, which exceeds the limit of 3")
+	assert.Len(t, tac.cards, 5)
+
+	assert.True(t, c.Approve())
+	_, err = c.sync(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, tac.cards, 0)
+}
+
+func TestControllerGrants(t *testing.T) {
+	tac := &testAccessController{cards: map[int]*client.Card{}}
+	tgs := &testGrantStorage{grants: []*reporting.Grant{{
+		ID:        "592af547-8f68-42d8-8b81-4a5d233b0009",
+		FobNumber: 900,
+		Name:      "Some Contractor",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}}}
+	c := &Controller{controller: tac, storage: &testUserStorage{}, grants: tgs}
+
+	_, err := c.sync(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[int]*client.Card{
+		0: {ID: 0, Number: 900, Name: "592af5478f6842d88b814a5d233b0009"},
+	}, tac.cards)
+	assert.Equal(t, tgs.grants[0].ExpiresAt, *c.nextTransition.Load())
+
+	tgs.grants[0].ExpiresAt = time.Now()
+	_, err = c.sync(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, tac.cards)
+
+	statuses, err := c.listCardStatus(context.Background())
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Expired)
+	assert.Equal(t, 900, statuses[0].Number)
+}
+
 type testAccessController struct {
-	lastID int
-	cards  map[int]*client.Card
+	lastID   int
+	cards    map[int]*client.Card
+	failAdd  map[int]error // keyed by fob number
+	onRemove func()
 }
 
 func (t *testAccessController) AddCard(ctx context.Context, num int, name string) error {
+	if err := t.failAdd[num]; err != nil {
+		return err
+	}
 	t.cards[t.lastID] = &client.Card{
 		ID:     t.lastID,
 		Number: num,
@@ -192,6 +784,9 @@ func (t *testAccessController) AddCard(ctx context.Context, num int, name string
 
 func (t *testAccessController) RemoveCard(ctx context.Context, id int) error {
 	delete(t.cards, id)
+	if t.onRemove != nil {
+		t.onRemove()
+	}
 	return nil
 }
 
@@ -203,16 +798,78 @@ func (t *testAccessController) ListCards(ctx context.Context) ([]*client.Card, e
 	return slice, nil
 }
 
+type testAuditLog struct {
+	changes []*reporting.CardChange
+}
+
+func (t *testAuditLog) RecordCardChange(ctx context.Context, change *reporting.CardChange) error {
+	t.changes = append(t.changes, change)
+	return nil
+}
+
+type testNotifier struct {
+	types []string
+	data  []any
+}
+
+func (t *testNotifier) Notify(eventType string, data any) {
+	t.types = append(t.types, eventType)
+	t.data = append(t.data, data)
+}
+
 type testUserStorage struct {
-	users []*keycloak.AccessUser
+	users    []*identity.AccessUser
+	err      error
+	listed   atomic.Int32
+	webhooks []*keycloak.Webhook
+	rules    *keycloak.Rules
+	groups   []string
 }
 
-func (t *testUserStorage) ListUsers(ctx context.Context) ([]*keycloak.AccessUser, error) {
-	return t.users, nil
+func (t *testUserStorage) ListUsers(ctx context.Context) ([]*identity.AccessUser, error) {
+	t.listed.Add(1)
+	return t.users, t.err
 }
 func (t *testUserStorage) CreateWebhook(ctx context.Context, webhook *keycloak.Webhook) error {
+	webhook.ID = fmt.Sprintf("hook-%d", len(t.webhooks)+100)
+	t.webhooks = append(t.webhooks, webhook)
 	return nil
 }
+func (t *testUserStorage) UpdateWebhook(ctx context.Context, webhook *keycloak.Webhook) error {
+	for i, hook := range t.webhooks {
+		if hook.ID == webhook.ID {
+			t.webhooks[i] = webhook
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+func (t *testUserStorage) DeleteWebhook(ctx context.Context, id string) error {
+	for i, hook := range t.webhooks {
+		if hook.ID == id {
+			t.webhooks = append(t.webhooks[:i], t.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+func (t *testUserStorage) Rules() *keycloak.Rules {
+	if t.rules == nil {
+		return &keycloak.Rules{KeyfobAttribute: "keyfobID"}
+	}
+	return t.rules
+}
+
+func (t *testUserStorage) Groups() []string { return t.groups }
+
 func (t *testUserStorage) ListWebhooks(ctx context.Context) ([]*keycloak.Webhook, error) {
-	return nil, nil
+	return append([]*keycloak.Webhook{}, t.webhooks...), nil
+}
+
+type testGrantStorage struct {
+	grants []*reporting.Grant
+}
+
+func (t *testGrantStorage) ListGrants(ctx context.Context) ([]*reporting.Grant, error) {
+	return t.grants, nil
 }
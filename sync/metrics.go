@@ -0,0 +1,39 @@
+package sync
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "access_controller_sync_duration_seconds",
+		Help:    "Time taken to sync an access controller with Keycloak, including failed syncs.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"controller"})
+
+	syncErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_controller_sync_errors_total",
+		Help: "Syncs that failed or were refused.",
+	}, []string{"controller"})
+
+	cardChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_controller_card_changes_total",
+		Help: "Cards added to or removed from the access controller.",
+	}, []string{"controller", "action"})
+
+	cardChangeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_controller_card_change_errors_total",
+		Help: "Failed attempts to add or remove cards.",
+	}, []string{"controller", "action"})
+
+	cardCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "access_controller_cards",
+		Help: "Cards on the access controller as of the last sync.",
+	}, []string{"controller"})
+
+	fobConflicts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "access_controller_fob_conflicts",
+		Help: "Fobs claimed by more than one user, or already in use on the access controller, as of the last sync.",
+	}, []string{"controller"})
+)
@@ -0,0 +1,260 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/identity"
+)
+
+// Plan is the set of changes needed to make an access controller's cards match the users in storage.
+type Plan struct {
+	Remove    []*Removal
+	Add       []*Addition
+	Conflicts []*Conflict // fobs claimed by more than one user, which don't count as changes
+}
+
+type Removal struct {
+	Card      *client.Card
+	Reason    string
+	Scheduled bool // the user's access schedule or grant has ended, so it counts towards the scheduled removal limit instead
+}
+
+type Addition struct {
+	UserUUID string
+	Number   int    // fob number
+	Name     string // card name, which identifies the user
+	Reason   string
+}
+
+// Conflict is a fob claimed by more than one user. Only the winner is given a card for it.
+type Conflict struct {
+	Number int      // fob number
+	Winner string   // UUID of the user who keeps the fob, empty if someone outside of storage has it
+	Losers []string // UUIDs of the users denied the fob
+	Reason string   // why the winner was chosen
+}
+
+// Empty returns true when the access controller is already in sync.
+func (p *Plan) Empty() bool { return len(p.Remove) == 0 && len(p.Add) == 0 }
+
+// unscheduledRemovals counts the removals that aren't explained by access schedules.
+func (p *Plan) unscheduledRemovals() (n int) {
+	for _, removal := range p.Remove {
+		if !removal.Scheduled {
+			n++
+		}
+	}
+	return n
+}
+
+// cardKey identifies a card by what's stored in it rather than the slot it happens to be in.
+type cardKey struct {
+	Number int
+	Name   string
+}
+
+// removedCards returns every card the plan removes.
+func (p *Plan) removedCards() map[cardKey]struct{} {
+	keys := map[cardKey]struct{}{}
+	for _, removal := range p.Remove {
+		keys[cardKey{removal.Card.Number, removal.Card.Name}] = struct{}{}
+	}
+	return keys
+}
+
+// removesOnly returns true if every card the plan removes is one of the given cards.
+func (p *Plan) removesOnly(keys map[cardKey]struct{}) bool {
+	for _, removal := range p.Remove {
+		if _, ok := keys[cardKey{removal.Card.Number, removal.Card.Name}]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Plan lists the current users and cards and returns the changes that sync would make, without making them.
+func (c *Controller) Plan(ctx context.Context) (*Plan, error) {
+	goalUsers, err := c.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cards, err := c.controller.ListCards(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing cards from access controller: %w", err)
+	}
+
+	return newPlan(goalUsers, cards, time.Now()), nil
+}
+
+func newPlan(goalUsers []*identity.AccessUser, cards []*client.Card, now time.Time) *Plan {
+	plan := &Plan{Remove: []*Removal{}, Add: []*Addition{}}
+
+	// Users without access right now (expired or outside their schedule) don't claim their fobs,
+	// so they can't keep a fob from someone who does have access
+	active := []*identity.AccessUser{}
+	inactiveByFobID := map[int][]*identity.AccessUser{}
+	for _, user := range goalUsers {
+		if inactiveReason(user, now) == "" {
+			active = append(active, user)
+			continue
+		}
+		for _, fob := range user.KeyfobNumbers {
+			inactiveByFobID[fob] = append(inactiveByFobID[fob], user)
+		}
+	}
+
+	// A fob can only be on the access controller once, so each fob goes to a single claimant
+	usersByFobID, conflicts := resolveFobOwners(active, cards)
+	plan.Conflicts = conflicts
+
+	// Clean up unused or incorrectly attributed cards
+	cardsByFobNumber := map[int]*client.Card{}
+	for _, card := range cards {
+		// Assume that names not managed by this tool are "First Last" and thus will contain a space
+		isManaged := !strings.Contains(card.Name, " ")
+
+		user := usersByFobID[card.Number]
+		if (user == nil && !isManaged) || (user != nil && trimDashes(user.UUID) == card.Name) {
+			cardsByFobNumber[card.Number] = card
+			continue
+		}
+
+		removal := &Removal{Card: card, Reason: "no authorized user has this fob"}
+		if user != nil {
+			removal.Reason = fmt.Sprintf("fob is assigned to user %s", user.UUID)
+		} else {
+			for _, inactive := range inactiveByFobID[card.Number] {
+				if trimDashes(inactive.UUID) == card.Name {
+					removal.Reason = inactiveReason(inactive, now)
+					removal.Scheduled = true
+					break
+				}
+			}
+		}
+		plan.Remove = append(plan.Remove, removal)
+	}
+
+	// Create missing cards, one for each of the user's fobs
+	for _, user := range goalUsers {
+		for _, fob := range user.KeyfobNumbers {
+			if usersByFobID[fob] != user {
+				continue // another user has the same fob
+			}
+			if _, ok := cardsByFobNumber[fob]; ok {
+				continue // already exists
+			}
+			cardsByFobNumber[fob] = nil // in case the user lists the same fob twice
+
+			add := &Addition{
+				UserUUID: user.UUID,
+				Number:   fob,
+				Name:     trimDashes(user.UUID),
+				Reason:   "authorized user has no card",
+			}
+			if len(user.KeyfobNumbers) > 1 {
+				add.Reason = "authorized user has no card for this fob"
+			}
+			if user.Schedule != nil {
+				add.Reason = fmt.Sprintf("within access schedule %q", user.Schedule)
+			}
+			plan.Add = append(plan.Add, add)
+		}
+	}
+
+	return plan
+}
+
+// resolveFobOwners picks one user for each fob from the users who currently have access. When more than one user has
+// the same fob, the oldest assignment wins: the user whose card is already on the access controller keeps it, otherwise
+// the oldest account gets it, with the lowest UUID breaking ties so the winner doesn't change between syncs.
+// Conflicts are returned in fob order.
+func resolveFobOwners(goalUsers []*identity.AccessUser, cards []*client.Card) (map[int]*identity.AccessUser, []*Conflict) {
+	claimants := map[int][]*identity.AccessUser{}
+	for _, user := range goalUsers {
+		for _, fob := range user.KeyfobNumbers {
+			if c := claimants[fob]; len(c) > 0 && c[len(c)-1] == user {
+				continue // the user lists the same fob twice
+			}
+			claimants[fob] = append(claimants[fob], user)
+		}
+	}
+
+	holders := map[int]string{} // card names by fob number
+	for _, card := range cards {
+		holders[card.Number] = card.Name
+	}
+
+	owners := map[int]*identity.AccessUser{}
+	conflicts := []*Conflict{}
+	for fob, users := range claimants {
+		if len(users) == 1 {
+			owners[fob] = users[0]
+			continue
+		}
+
+		holds := func(user *identity.AccessUser) bool { return holders[fob] == trimDashes(user.UUID) }
+		sort.SliceStable(users, func(i, j int) bool {
+			a, b := users[i], users[j]
+			if holds(a) != holds(b) {
+				return holds(a)
+			}
+			if aUnknown, bUnknown := a.CreatedAt.IsZero(), b.CreatedAt.IsZero(); aUnknown != bUnknown {
+				return bUnknown // unknown creation times go last
+			}
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+			return trimDashes(a.UUID) < trimDashes(b.UUID)
+		})
+
+		winner := users[0]
+		owners[fob] = winner
+		conflict := &Conflict{Number: fob, Winner: winner.UUID, Reason: "lowest user ID"}
+		switch {
+		case holds(winner):
+			conflict.Reason = "user already has a card for this fob"
+		case !winner.CreatedAt.IsZero() && !winner.CreatedAt.Equal(users[1].CreatedAt):
+			conflict.Reason = "oldest account"
+		}
+		for _, user := range users[1:] {
+			conflict.Losers = append(conflict.Losers, user.UUID)
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Number < conflicts[j].Number })
+
+	return owners, conflicts
+}
+
+// inactiveReason explains why a user shouldn't have access right now, or returns an empty string if they should.
+func inactiveReason(user *identity.AccessUser, now time.Time) string {
+	if !user.ExpiresAt.IsZero() && !now.Before(user.ExpiresAt) {
+		return fmt.Sprintf("access expired at %s", user.ExpiresAt.Format(time.RFC3339))
+	}
+	if user.Schedule != nil && !user.Schedule.Active(now) {
+		return fmt.Sprintf("outside of access schedule %q", user.Schedule)
+	}
+	return ""
+}
+
+// nextScheduleTransition returns the soonest time any user's access starts or ends, or zero if never.
+func nextScheduleTransition(users []*identity.AccessUser, now time.Time) (next time.Time) {
+	for _, user := range users {
+		candidates := []time.Time{user.ExpiresAt}
+		if user.Schedule != nil {
+			candidates = append(candidates, user.Schedule.Next(now))
+		}
+		for _, t := range candidates {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+	return next
+}
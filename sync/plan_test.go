@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TheLab-ms/access-controller-controller/client"
+	"github.com/TheLab-ms/access-controller-controller/identity"
+	"github.com/TheLab-ms/access-controller-controller/schedule"
+)
+
+func TestPlan(t *testing.T) {
+	tac := &testAccessController{lastID: 4, cards: map[int]*client.Card{
+		1: {ID: 1, Number: 100, Name: "592af5478f6842d88b814a5d233b0001"}, // correct
+		2: {ID: 2, Number: 200, Name: "592af5478f6842d88b814a5d233b9999"}, // wrong user
+		3: {ID: 3, Number: 300, Name: "Unmanaged User"},                   // not ours
+		4: {ID: 4, Number: 400, Name: "592af5478f6842d88b814a5d233b0004"}, // stale
+	}}
+	tus := &testUserStorage{users: []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{200}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0005", KeyfobNumbers: []int{500}},
+	}}
+
+	c := &Controller{controller: tac, storage: tus, dryRun: true}
+
+	plan, err := c.Plan(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*Removal{
+		{Card: tac.cards[2], Reason: "fob is assigned to user 592af547-8f68-42d8-8b81-4a5d233b0002"},
+		{Card: tac.cards[4], Reason: "no authorized user has this fob"},
+	}, plan.Remove)
+	assert.Equal(t, []*Addition{
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0002", Number: 200, Name: "592af5478f6842d88b814a5d233b0002", Reason: "authorized user has no card"},
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0005", Number: 500, Name: "592af5478f6842d88b814a5d233b0005", Reason: "authorized user has no card"},
+	}, plan.Add)
+
+	t.Run("dry run", func(t *testing.T) {
+		changed, err := c.sync(context.Background())
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Len(t, tac.cards, 4)
+	})
+}
+
+func TestPlanMultipleFobs(t *testing.T) {
+	cards := []*client.Card{
+		{ID: 1, Number: 100, Name: "592af5478f6842d88b814a5d233b0001"}, // still in use
+		{ID: 2, Number: 200, Name: "592af5478f6842d88b814a5d233b0001"}, // replaced
+	}
+	users := []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100, 300, 300}},
+	}
+
+	plan := newPlan(users, cards, time.Now())
+	assert.Equal(t, []*Removal{
+		{Card: cards[1], Reason: "no authorized user has this fob"},
+	}, plan.Remove)
+	assert.Equal(t, []*Addition{
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Number: 300, Name: "592af5478f6842d88b814a5d233b0001", Reason: "authorized user has no card for this fob"},
+	}, plan.Add)
+}
+
+func TestPlanConflicts(t *testing.T) {
+	created := time.Date(2023, 6, 19, 0, 0, 0, 0, time.UTC)
+	users := []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0003", KeyfobNumbers: []int{100, 200, 300}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{100, 200}, CreatedAt: created.Add(time.Hour)},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100, 300}, CreatedAt: created},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0004", KeyfobNumbers: []int{400}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0005", KeyfobNumbers: []int{400}},
+	}
+	cards := []*client.Card{
+		{ID: 1, Number: 200, Name: "592af5478f6842d88b814a5d233b0003"}, // the current holder keeps the fob
+	}
+
+	plan := newPlan(users, cards, time.Now())
+	assert.Equal(t, []*Conflict{
+		{Number: 100, Winner: "592af547-8f68-42d8-8b81-4a5d233b0001", Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0002", "592af547-8f68-42d8-8b81-4a5d233b0003"}, Reason: "oldest account"},
+		{Number: 200, Winner: "592af547-8f68-42d8-8b81-4a5d233b0003", Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0002"}, Reason: "user already has a card for this fob"},
+		{Number: 300, Winner: "592af547-8f68-42d8-8b81-4a5d233b0001", Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0003"}, Reason: "oldest account"},
+		{Number: 400, Winner: "592af547-8f68-42d8-8b81-4a5d233b0004", Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0005"}, Reason: "lowest user ID"},
+	}, plan.Conflicts)
+	assert.Empty(t, plan.Remove)
+	assert.Len(t, plan.Add, 3)
+
+	// The winners don't depend on the order the users are listed in
+	reversed := []*identity.AccessUser{}
+	for i := len(users) - 1; i >= 0; i-- {
+		reversed = append(reversed, users[i])
+	}
+	again := newPlan(reversed, cards, time.Now())
+	assert.Equal(t, plan.Conflicts, again.Conflicts)
+	assert.ElementsMatch(t, plan.Add, again.Add)
+}
+
+func TestPlanInactiveClaimants(t *testing.T) {
+	sched, err := schedule.Parse("Mon-Fri 17:00-22:00", time.UTC)
+	require.NoError(t, err)
+
+	now := time.Date(2023, 6, 19, 12, 0, 0, 0, time.UTC) // Monday, outside the schedule
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100}, ExpiresAt: now.Add(-time.Hour), CreatedAt: created},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{100}, CreatedAt: created.Add(time.Hour)},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0003", KeyfobNumbers: []int{200}, Schedule: sched, CreatedAt: created},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0004", KeyfobNumbers: []int{200}, CreatedAt: created.Add(time.Hour)},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0005", KeyfobNumbers: []int{300}},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0006", KeyfobNumbers: []int{300}, Schedule: sched},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0007", KeyfobNumbers: []int{300}},
+	}
+	cards := []*client.Card{
+		{ID: 1, Number: 100, Name: "592af5478f6842d88b814a5d233b0001"}, // expired
+		{ID: 2, Number: 300, Name: "592af5478f6842d88b814a5d233b0006"}, // outside of schedule
+	}
+
+	plan := newPlan(users, cards, now)
+
+	// Only the claimants with access right now compete for a fob, and holding its card only counts for them
+	assert.Equal(t, []*Conflict{
+		{Number: 300, Winner: "592af547-8f68-42d8-8b81-4a5d233b0005", Losers: []string{"592af547-8f68-42d8-8b81-4a5d233b0007"}, Reason: "lowest user ID"},
+	}, plan.Conflicts)
+	assert.Equal(t, []*Removal{
+		{Card: cards[0], Reason: "fob is assigned to user 592af547-8f68-42d8-8b81-4a5d233b0002"},
+		{Card: cards[1], Reason: "fob is assigned to user 592af547-8f68-42d8-8b81-4a5d233b0005"},
+	}, plan.Remove)
+	assert.Equal(t, []*Addition{
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0002", Number: 100, Name: "592af5478f6842d88b814a5d233b0002", Reason: "authorized user has no card"},
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0004", Number: 200, Name: "592af5478f6842d88b814a5d233b0004", Reason: "authorized user has no card"},
+		{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0005", Number: 300, Name: "592af5478f6842d88b814a5d233b0005", Reason: "authorized user has no card"},
+	}, plan.Add)
+
+	// Once the active claimant is gone, the inactive holder's card is removed on schedule as usual
+	plan = newPlan(users[:1], cards[:1], now)
+	assert.Empty(t, plan.Conflicts)
+	assert.Equal(t, []*Removal{
+		{Card: cards[0], Reason: "access expired at 2023-06-19T11:00:00Z", Scheduled: true},
+	}, plan.Remove)
+}
+
+func TestPlanSchedules(t *testing.T) {
+	sched, err := schedule.Parse("Mon-Fri 17:00-22:00", time.UTC)
+	require.NoError(t, err)
+
+	users := []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100}, Schedule: sched},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{200}},
+	}
+	monday := time.Date(2023, 6, 19, 0, 0, 0, 0, time.UTC)
+
+	t.Run("inside window", func(t *testing.T) {
+		plan := newPlan(users, nil, monday.Add(time.Hour*18))
+		assert.Empty(t, plan.Remove)
+		assert.Equal(t, []*Addition{
+			{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0001", Number: 100, Name: "592af5478f6842d88b814a5d233b0001", Reason: `within access schedule "Mon,Tue,Wed,Thu,Fri 17:00-22:00"`},
+			{UserUUID: "592af547-8f68-42d8-8b81-4a5d233b0002", Number: 200, Name: "592af5478f6842d88b814a5d233b0002", Reason: "authorized user has no card"},
+		}, plan.Add)
+	})
+
+	t.Run("outside window", func(t *testing.T) {
+		cards := []*client.Card{
+			{ID: 1, Number: 100, Name: "592af5478f6842d88b814a5d233b0001"},
+			{ID: 2, Number: 200, Name: "592af5478f6842d88b814a5d233b0002"},
+		}
+		plan := newPlan(users, cards, monday.Add(time.Hour*22))
+		assert.Empty(t, plan.Add)
+		assert.Equal(t, []*Removal{
+			{Card: cards[0], Reason: `outside of access schedule "Mon,Tue,Wed,Thu,Fri 17:00-22:00"`, Scheduled: true},
+		}, plan.Remove)
+		assert.Equal(t, 0, plan.unscheduledRemovals())
+	})
+
+	t.Run("next transition", func(t *testing.T) {
+		assert.Equal(t, monday.Add(time.Hour*17), nextScheduleTransition(users, monday))
+		assert.True(t, nextScheduleTransition(users[1:], monday).IsZero())
+	})
+}
+
+func TestPlanExpiration(t *testing.T) {
+	now := time.Date(2023, 6, 19, 12, 0, 0, 0, time.UTC)
+	users := []*identity.AccessUser{
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0001", KeyfobNumbers: []int{100}, ExpiresAt: now},
+		{UUID: "592af547-8f68-42d8-8b81-4a5d233b0002", KeyfobNumbers: []int{200}, ExpiresAt: now.Add(time.Hour)},
+	}
+	cards := []*client.Card{
+		{ID: 1, Number: 100, Name: "592af5478f6842d88b814a5d233b0001"},
+		{ID: 2, Number: 200, Name: "592af5478f6842d88b814a5d233b0002"},
+	}
+
+	plan := newPlan(users, cards, now)
+	assert.Empty(t, plan.Add)
+	assert.Equal(t, []*Removal{
+		{Card: cards[0], Reason: "access expired at 2023-06-19T12:00:00Z", Scheduled: true},
+	}, plan.Remove)
+
+	assert.Equal(t, now.Add(time.Hour), nextScheduleTransition(users, now))
+}